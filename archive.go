@@ -0,0 +1,400 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/strutil"
+	"shanhu.io/misc/tarutil"
+)
+
+// defaultArchiveModTime is the modification time of files in archives
+// when the rule does not specify one. It is the earliest time that can be
+// saved in a zip file.
+var defaultArchiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func parseArchiveModTime(s string) (time.Time, error) {
+	if s == "" {
+		return defaultArchiveModTime, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errcode.InvalidArgf("invalid mod time %q", s)
+	}
+	return t.UTC(), nil
+}
+
+// archiveFiles is the input file list of an archive rule.
+type archiveFiles struct {
+	inputs      []string
+	stripPrefix string
+	addPrefix   string
+	modTime     time.Time
+}
+
+func newArchiveFiles(p string, inputs []string, strip, add, modTime string) (
+	*archiveFiles, error,
+) {
+	m := make(map[string]bool)
+	for _, input := range inputs {
+		m[makePath(p, input)] = true
+	}
+
+	if strip == "." {
+		strip = p
+	}
+	strip = strings.TrimSuffix(strip, "/")
+
+	if add != "" {
+		if path.IsAbs(add) {
+			return nil, errcode.InvalidArgf("add prefix %q is absolute", add)
+		}
+		add = path.Clean(add)
+		if add == ".." || strings.HasPrefix(add, "../") {
+			return nil, errcode.InvalidArgf(
+				"add prefix %q escapes the archive root", add,
+			)
+		}
+	}
+
+	t, err := parseArchiveModTime(modTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveFiles{
+		inputs:      strutil.SortedList(m),
+		stripPrefix: strip,
+		addPrefix:   add,
+		modTime:     t,
+	}, nil
+}
+
+type archiveFile struct {
+	name string // Name in the archive.
+	path string // Path on the file system.
+	mode int64
+}
+
+func (a *archiveFiles) list(env *env) ([]*archiveFile, error) {
+	files, err := inputFiles(env, a.inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []*archiveFile
+	for _, name := range names {
+		archName := name
+		if a.stripPrefix != "" {
+			prefix := a.stripPrefix + "/"
+			if !strings.HasPrefix(name, prefix) {
+				return nil, errcode.InvalidArgf(
+					"%q is not under %q", name, a.stripPrefix,
+				)
+			}
+			archName = strings.TrimPrefix(name, prefix)
+		}
+		if a.addPrefix != "" {
+			archName = path.Join(a.addPrefix, archName)
+		}
+
+		fp := files[name]
+		stat, err := os.Stat(fp)
+		if err != nil {
+			return nil, errcode.Annotatef(err, "stat file %q", name)
+		}
+		mode := stat.Mode()
+		if !mode.IsRegular() {
+			return nil, errcode.Internalf("%q is not a regular file", name)
+		}
+		list = append(list, &archiveFile{
+			name: archName,
+			path: fp,
+			mode: int64(mode.Perm()),
+		})
+	}
+	return list, nil
+}
+
+func tarOut(name, compress string) string {
+	switch compress {
+	case "gzip":
+		return name + ".tar.gz"
+	case "zstd":
+		return name + ".tar.zst"
+	}
+	return name + ".tar"
+}
+
+type tarRule struct {
+	name  string
+	rule  *Tar
+	files *archiveFiles
+	out   string
+}
+
+func newTar(env *env, p string, r *Tar) (*tarRule, error) {
+	switch r.Compress {
+	case "", "gzip", "zstd":
+	default:
+		return nil, errcode.InvalidArgf("unknown compression %q", r.Compress)
+	}
+
+	files, err := newArchiveFiles(
+		p, r.Input, r.StripPrefix, r.AddPrefix, r.ModTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	name := makeRelPath(p, r.Name)
+	return &tarRule{
+		name:  name,
+		rule:  r,
+		files: files,
+		out:   tarOut(name, r.Compress),
+	}, nil
+}
+
+func (t *tarRule) meta(env *env) (*buildRuleMeta, error) {
+	rule := *t.rule
+	clearNonOutputFields(&rule)
+	digest, err := makeDigest(ruleTar, t.name, &rule)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+	return &buildRuleMeta{
+		name:   t.name,
+		deps:   t.files.inputs,
+		outs:   []string{t.out},
+		digest: digest,
+	}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func compressWriter(w io.Writer, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		// Single-threaded, so that the output does not depend on the
+		// number of CPUs.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, errcode.InvalidArgf("unknown compression %q", compress)
+}
+
+// writeFixedTar writes the tar stream into w, with the modification time
+// of all files set to t. tarutil.Stream always uses the current time, so
+// the headers are rewritten.
+func writeFixedTar(w io.Writer, ts *tarutil.Stream, t time.Time) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := ts.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // Unblocks the writing when returning early.
+
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(w)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errcode.Annotate(err, "read tar stream")
+		}
+
+		h.ModTime = t
+		h.AccessTime = time.Time{}
+		h.ChangeTime = time.Time{}
+		h.PAXRecords = nil
+		h.Format = tar.FormatUnknown
+
+		if err := tw.WriteHeader(h); err != nil {
+			return errcode.Annotatef(err, "write header of %q", h.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errcode.Annotatef(err, "write %q", h.Name)
+		}
+	}
+	return tw.Close()
+}
+
+func (t *tarRule) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	files, err := t.files.list(env)
+	if err != nil {
+		return err
+	}
+
+	meta := &tarutil.Meta{
+		UserID:  t.rule.UserID,
+		GroupID: t.rule.GroupID,
+	}
+	ts := tarutil.NewStream()
+	for _, f := range files {
+		m := *meta
+		m.Mode = f.mode
+		ts.AddFile(f.name, &m, f.path)
+	}
+
+	out, err := env.prepareOut(t.out)
+	if err != nil {
+		return errcode.Annotate(err, "prepare output")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return errcode.Annotate(err, "create output")
+	}
+	defer f.Close()
+
+	w, err := compressWriter(f, t.rule.Compress)
+	if err != nil {
+		return err
+	}
+	if err := writeFixedTar(w, ts, t.files.modTime); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return errcode.Annotate(err, "close compression")
+	}
+	return f.Close()
+}
+
+func zipOut(name string) string { return name + ".zip" }
+
+type zipRule struct {
+	name  string
+	rule  *Zip
+	files *archiveFiles
+	out   string
+}
+
+func newZip(env *env, p string, r *Zip) (*zipRule, error) {
+	files, err := newArchiveFiles(
+		p, r.Input, r.StripPrefix, r.AddPrefix, r.ModTime,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if files.modTime.Before(defaultArchiveModTime) {
+		return nil, errcode.InvalidArgf(
+			"mod time %q is before 1980", r.ModTime,
+		)
+	}
+
+	name := makeRelPath(p, r.Name)
+	return &zipRule{
+		name:  name,
+		rule:  r,
+		files: files,
+		out:   zipOut(name),
+	}, nil
+}
+
+func (z *zipRule) meta(env *env) (*buildRuleMeta, error) {
+	rule := *z.rule
+	clearNonOutputFields(&rule)
+	digest, err := makeDigest(ruleZip, z.name, &rule)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+	return &buildRuleMeta{
+		name:   z.name,
+		deps:   z.files.inputs,
+		outs:   []string{z.out},
+		digest: digest,
+	}, nil
+}
+
+func addZipFile(zw *zip.Writer, f *archiveFile, t time.Time) error {
+	h := &zip.FileHeader{
+		Name:     f.name,
+		Method:   zip.Deflate,
+		Modified: t,
+	}
+	h.SetMode(fs.FileMode(f.mode))
+	w, err := zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func (z *zipRule) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	files, err := z.files.list(env)
+	if err != nil {
+		return err
+	}
+
+	out, err := env.prepareOut(z.out)
+	if err != nil {
+		return errcode.Annotate(err, "prepare output")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return errcode.Annotate(err, "create output")
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for _, file := range files {
+		if err := addZipFile(zw, file, z.files.modTime); err != nil {
+			return errcode.Annotatef(err, "add %q", file.name)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return errcode.Annotate(err, "close zip")
+	}
+	return f.Close()
+}
@@ -0,0 +1,399 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/tarutil"
+)
+
+// archiveOptions resolves the archive options of a rule, where the keys
+// are relative to the build file. The keys must be archive inputs in m.
+func archiveOptions(
+	p string, opts map[string]*ArchiveOptions, m map[string]bool,
+) (map[string]*ArchiveOptions, error) {
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	ret := make(map[string]*ArchiveOptions)
+	for k, v := range opts {
+		in := makePath(p, k)
+		if !m[in] {
+			return nil, errcode.InvalidArgf(
+				"archive options of %q, which is not an archive input", k,
+			)
+		}
+		if v == nil {
+			continue
+		}
+		if v.StripComponents < 0 {
+			return nil, errcode.InvalidArgf(
+				"negative strip components for %q", k,
+			)
+		}
+		ret[in] = v
+	}
+	return ret, nil
+}
+
+// archiveEntryName returns the name of an archive entry after filtering
+// and stripping with opts. It returns false if the entry is skipped.
+func archiveEntryName(name string, opts *ArchiveOptions) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "", false
+	}
+	if opts.Subdir != "" {
+		dir := strings.Trim(path.Clean(opts.Subdir), "/")
+		if !strings.HasPrefix(name, dir+"/") {
+			return "", false
+		}
+	}
+	if n := opts.StripComponents; n > 0 {
+		parts := strings.Split(name, "/")
+		if len(parts) <= n {
+			return "", false
+		}
+		name = path.Join(parts[n:]...)
+	}
+	return name, true
+}
+
+func openTarball(f *os.File, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return io.NopCloser(f), nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return gzip.NewReader(f)
+	case strings.HasSuffix(name, ".tar.zst"),
+		strings.HasSuffix(name, ".tzst"):
+		d, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, errcode.InvalidArgf("unknown archive type %q", name)
+}
+
+// archiveStream is a tar stream of input files. Files from archive inputs
+// are extracted into a temp directory first, and their symlinks are
+// appended after all the files, as tarutil.Stream only holds files.
+type archiveStream struct {
+	*tarutil.Stream
+
+	tmpDir string
+	links  []*tar.Header
+	// Names of symlinks, and of directories that have files, so that no
+	// file is written through a symlink when extracting the stream.
+	linkSet map[string]bool
+	dirSet  map[string]bool
+}
+
+func newArchiveStream() *archiveStream {
+	return &archiveStream{
+		Stream:  tarutil.NewStream(),
+		linkSet: make(map[string]bool),
+		dirSet:  make(map[string]bool),
+	}
+}
+
+func (s *archiveStream) checkParents(name string) error {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if s.linkSet[dir] {
+			return errcode.InvalidArgf(
+				"parent %q of %q is a symlink", dir, name,
+			)
+		}
+	}
+	return nil
+}
+
+// addFile adds a file extracted from an archive. The content is copied
+// into a temp file, so that large archives are not held in memory. It
+// returns the path of the temp file.
+func (s *archiveStream) addFile(
+	name string, meta *tarutil.Meta, r io.Reader,
+) (string, error) {
+	if err := s.checkParents(name); err != nil {
+		return "", err
+	}
+	if s.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "caco3-archive-")
+		if err != nil {
+			return "", errcode.Annotate(err, "make temp dir")
+		}
+		s.tmpDir = dir
+	}
+	f, err := os.CreateTemp(s.tmpDir, "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	s.addExtracted(name, meta, f.Name())
+	return f.Name(), nil
+}
+
+func (s *archiveStream) addExtracted(
+	name string, meta *tarutil.Meta, f string,
+) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		s.dirSet[dir] = true
+	}
+	s.AddFile(name, meta, f)
+}
+
+// addSymlink adds a symlink of archive entry name under dir, which links
+// to link. The link must be relative and stay inside dir.
+func (s *archiveStream) addSymlink(dir, entry, link string) error {
+	if err := checkSymlink(entry, link); err != nil {
+		return err
+	}
+	name := path.Join(dir, entry)
+	if err := s.checkParents(name); err != nil {
+		return err
+	}
+	if s.dirSet[name] {
+		return errcode.InvalidArgf("symlink %q is also a directory", name)
+	}
+	s.linkSet[name] = true
+	s.links = append(s.links, &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: link,
+		Mode:     0777,
+	})
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	n, err := w.w.Write(bs)
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the tar stream into w.
+func (s *archiveStream) WriteTo(w io.Writer) (int64, error) {
+	if len(s.links) == 0 {
+		return s.Stream.WriteTo(w)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := s.Stream.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // Unblocks the writing when returning early.
+
+	cw := &countingWriter{w: w}
+	tr := tar.NewReader(pr)
+	tw := tar.NewWriter(cw)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cw.n, errcode.Annotate(err, "read tar stream")
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return cw.n, errcode.Annotatef(err, "write header %q", h.Name)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return cw.n, errcode.Annotatef(err, "write %q", h.Name)
+		}
+	}
+	for _, h := range s.links {
+		if err := tw.WriteHeader(h); err != nil {
+			return cw.n, errcode.Annotatef(err, "write %q", h.Name)
+		}
+	}
+	err := tw.Close()
+	return cw.n, err
+}
+
+// Close removes the extracted files.
+func (s *archiveStream) Close() error {
+	if s.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.tmpDir)
+}
+
+// addTarball adds the files and links in a tarball into the stream, under
+// directory dir. Hard links are added as copies of the linked files.
+func (s *archiveStream) addTarball(
+	dir, name, f string, opts *ArchiveOptions,
+) error {
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := openTarball(file, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := make(map[string]string) // Extracted files by entry names.
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errcode.Annotate(err, "read tarball")
+		}
+
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		entry, ok := archiveEntryName(h.Name, opts)
+		if !ok {
+			continue
+		}
+		p := path.Join(dir, entry)
+		meta := &tarutil.Meta{
+			Mode:    h.Mode & 0777,
+			UserID:  h.Uid,
+			GroupID: h.Gid,
+		}
+
+		switch h.Typeflag {
+		case tar.TypeReg:
+			tmp, err := s.addFile(p, meta, tr)
+			if err != nil {
+				return errcode.Annotatef(err, "extract %q", h.Name)
+			}
+			files[entry] = tmp
+		case tar.TypeDir:
+			continue // Directories are created with the files.
+		case tar.TypeSymlink:
+			if err := s.addSymlink(dir, entry, h.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, ok := archiveEntryName(h.Linkname, opts)
+			if !ok || files[target] == "" {
+				return errcode.InvalidArgf(
+					"%q links to %q, which is not extracted",
+					h.Name, h.Linkname,
+				)
+			}
+			if err := s.checkParents(p); err != nil {
+				return err
+			}
+			s.addExtracted(p, meta, files[target])
+		default:
+			return errcode.InvalidArgf(
+				"%q is not a regular file, directory or link", h.Name,
+			)
+		}
+	}
+	return nil
+}
+
+// addZipArchive adds the files and symlinks in a zip file into the stream,
+// under directory dir.
+func (s *archiveStream) addZipArchive(
+	dir, f string, opts *ArchiveOptions,
+) error {
+	z, err := zip.OpenReader(f)
+	if err != nil {
+		return errcode.Annotate(err, "open zip file")
+	}
+	defer z.Close()
+
+	for _, file := range z.File {
+		entry, ok := archiveEntryName(file.Name, opts)
+		if !ok {
+			continue
+		}
+		p := path.Join(dir, entry)
+		mode := file.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+			return errcode.InvalidArgf(
+				"%q is not a regular file or symlink", file.Name,
+			)
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return errcode.Annotatef(err, "open %q", file.Name)
+		}
+		if mode.IsRegular() {
+			meta := tarutil.ModeMeta(int64(mode.Perm()))
+			_, err = s.addFile(p, meta, rc)
+		} else {
+			// The content of a symlink is the path that it links to.
+			var link []byte
+			link, err = io.ReadAll(io.LimitReader(rc, maxZipLinkLen))
+			if err == nil {
+				err = s.addSymlink(dir, entry, string(link))
+			}
+		}
+		rc.Close()
+		if err != nil {
+			return errcode.Annotatef(err, "extract %q", file.Name)
+		}
+	}
+	return nil
+}
+
+// maxZipLinkLen is the maximum length of the target of a symlink in a zip
+// file.
+const maxZipLinkLen = 4096
+
+// addArchive adds the files in archive input f, which is named name, into
+// the stream under directory dir.
+func (s *archiveStream) addArchive(
+	dir, name, f string, opts *ArchiveOptions,
+) error {
+	if opts == nil {
+		opts = new(ArchiveOptions)
+	}
+	if strings.HasSuffix(name, ".zip") {
+		return s.addZipArchive(dir, f, opts)
+	}
+	return s.addTarball(dir, name, f, opts)
+}
@@ -0,0 +1,248 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchiveEntryName(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts *ArchiveOptions
+		want string // Empty for skipped.
+	}{
+		{"a/b.txt", &ArchiveOptions{}, "a/b.txt"},
+		{"./a/b.txt", &ArchiveOptions{}, "a/b.txt"},
+		{"/a/b.txt", &ArchiveOptions{}, "a/b.txt"},
+		{"../../a", &ArchiveOptions{}, "a"},
+		{"./", &ArchiveOptions{}, ""},
+		{"a/b.txt", &ArchiveOptions{Subdir: "a"}, "a/b.txt"},
+		{"a/b.txt", &ArchiveOptions{Subdir: "/a/"}, "a/b.txt"},
+		{"ab/c.txt", &ArchiveOptions{Subdir: "a"}, ""},
+		{"a", &ArchiveOptions{Subdir: "a"}, ""},
+		{"a/b/c.txt", &ArchiveOptions{StripComponents: 1}, "b/c.txt"},
+		{"a/b/c.txt", &ArchiveOptions{StripComponents: 2}, "c.txt"},
+		{"a/b", &ArchiveOptions{StripComponents: 2}, ""},
+		{
+			"node/bin/node",
+			&ArchiveOptions{Subdir: "node/bin", StripComponents: 1},
+			"bin/node",
+		},
+	} {
+		got, ok := archiveEntryName(test.name, test.opts)
+		if test.want == "" {
+			if ok {
+				t.Errorf(
+					"archiveEntryName(%q, %+v) got %q, want skipped",
+					test.name, test.opts, got,
+				)
+			}
+			continue
+		}
+		if !ok || got != test.want {
+			t.Errorf(
+				"archiveEntryName(%q, %+v) got %q, %t, want %q",
+				test.name, test.opts, got, ok, test.want,
+			)
+		}
+	}
+}
+
+type testArchiveEntry struct {
+	name string
+	link string // Set for symlinks.
+	body string
+}
+
+func readTestArchiveStream(
+	t *testing.T, s *archiveStream,
+) []*testArchiveEntry {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if _, err := s.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	var entries []*testArchiveEntry
+	tr := tar.NewReader(buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &testArchiveEntry{
+			name: h.Name,
+			link: h.Linkname,
+			body: string(bs),
+		})
+	}
+	return entries
+}
+
+func writeTestTarball(
+	t *testing.T, f string, files []*fakeTarFile,
+) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if err := writeFakeTar(buf, files); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveStreamTarball(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "node.tar")
+	writeTestTarball(t, f, []*fakeTarFile{
+		{name: "node/", typ: tar.TypeDir},
+		{name: "node/bin/", typ: tar.TypeDir},
+		{name: "node/lib/cli.js", typ: tar.TypeReg, body: "cli"},
+		{name: "node/bin/npm", typ: tar.TypeSymlink, link: "../lib/cli.js"},
+		{name: "node/bin/npm2", typ: tar.TypeLink, link: "node/lib/cli.js"},
+	})
+
+	s := newArchiveStream()
+	opts := &ArchiveOptions{StripComponents: 1}
+	if err := s.addArchive("opt", "node.tar", f, opts); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestArchiveStream(t, s)
+	want := []*testArchiveEntry{
+		{name: "opt/lib/cli.js", body: "cli"},
+		{name: "opt/bin/npm2", body: "cli"},
+		{name: "opt/bin/npm", link: "../lib/cli.js"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	tmpDir := s.tmpDir
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("temp dir not removed: %v", err)
+	}
+}
+
+func TestArchiveStreamTarballEscape(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files []*fakeTarFile
+	}{{
+		name: "absolute link",
+		files: []*fakeTarFile{
+			{name: "etc", typ: tar.TypeSymlink, link: "/etc"},
+		},
+	}, {
+		name: "link outside",
+		files: []*fakeTarFile{
+			{name: "a/up", typ: tar.TypeSymlink, link: "../../x"},
+		},
+	}, {
+		name: "write through link",
+		files: []*fakeTarFile{
+			{name: "d", typ: tar.TypeSymlink, link: "sub"},
+			{name: "d/x", typ: tar.TypeReg, body: "x"},
+		},
+	}, {
+		name: "link over dir",
+		files: []*fakeTarFile{
+			{name: "d/x", typ: tar.TypeReg, body: "x"},
+			{name: "d", typ: tar.TypeSymlink, link: "sub"},
+		},
+	}, {
+		name: "hard link not extracted",
+		files: []*fakeTarFile{
+			{name: "x", typ: tar.TypeLink, link: "/etc/passwd"},
+		},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			f := filepath.Join(t.TempDir(), "a.tar")
+			writeTestTarball(t, f, test.files)
+
+			s := newArchiveStream()
+			defer s.Close()
+			if err := s.addArchive("opt", "a.tar", f, nil); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestArchiveStreamZip(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "a.zip")
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, file := range []struct {
+		name string
+		mode fs.FileMode
+		body string
+	}{
+		{"a/", fs.ModeDir | 0755, ""},
+		{"a/x.txt", 0644, "x"},
+		{"a/y.txt", fs.ModeSymlink | 0777, "x.txt"},
+	} {
+		h := &zip.FileHeader{Name: file.name}
+		h.SetMode(file.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, file.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Zip files are added the same way with or without options.
+	for _, opts := range []*ArchiveOptions{nil, {}} {
+		s := newArchiveStream()
+		defer s.Close()
+		if err := s.addArchive("opt", "a.zip", f, opts); err != nil {
+			t.Fatal(err)
+		}
+		got := readTestArchiveStream(t, s)
+		want := []*testArchiveEntry{
+			{name: "opt/a/x.txt", body: "x"},
+			{name: "opt/a/y.txt", link: "x.txt"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("opts %+v, got %+v, want %+v", opts, got, want)
+		}
+	}
+}
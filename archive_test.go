@@ -0,0 +1,237 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/tarutil"
+)
+
+func TestWriteFixedTar(t *testing.T) {
+	for _, modTime := range []time.Time{
+		defaultArchiveModTime,
+		time.Date(2022, 8, 1, 12, 30, 0, 0, time.UTC),
+	} {
+		ts := tarutil.NewStream()
+		ts.AddString("a.txt", tarutil.ModeMeta(0644), "a")
+		ts.AddString("bin/b", &tarutil.Meta{
+			Mode:    0755,
+			UserID:  1000,
+			GroupID: 1000,
+		}, "b")
+
+		buf := new(bytes.Buffer)
+		if err := writeFixedTar(buf, ts, modTime); err != nil {
+			t.Fatal(err)
+		}
+
+		type entry struct {
+			name     string
+			mode     int64
+			uid, gid int
+			body     string
+		}
+		want := []*entry{
+			{name: "a.txt", mode: 0644, body: "a"},
+			{name: "bin/b", mode: 0755, uid: 1000, gid: 1000, body: "b"},
+		}
+
+		tr := tar.NewReader(buf)
+		for i := 0; ; i++ {
+			h, err := tr.Next()
+			if err == io.EOF {
+				if i != len(want) {
+					t.Errorf("got %d entries, want %d", i, len(want))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i >= len(want) {
+				t.Fatalf("unexpected entry %q", h.Name)
+			}
+			bs, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &entry{
+				name: h.Name,
+				mode: h.Mode,
+				uid:  h.Uid,
+				gid:  h.Gid,
+				body: string(bs),
+			}
+			if *got != *want[i] {
+				t.Errorf("entry %d: got %+v, want %+v", i, got, want[i])
+			}
+			if !h.ModTime.Equal(modTime) {
+				t.Errorf(
+					"%q: got mod time %s, want %s",
+					h.Name, h.ModTime, modTime,
+				)
+			}
+			if len(h.PAXRecords) != 0 {
+				t.Errorf("%q: got PAX records %v", h.Name, h.PAXRecords)
+			}
+		}
+	}
+}
+
+func newTestArchiveEnv(t *testing.T, files map[string]string) *env {
+	t.Helper()
+	dir := t.TempDir()
+	env := &env{
+		srcDir: filepath.Join(dir, "src"),
+		outDir: filepath.Join(dir, "out"),
+		nodeType: func(name string) string {
+			if _, ok := files[name]; ok {
+				return nodeSrc
+			}
+			return ""
+		},
+	}
+	for name, content := range files {
+		f := env.src(name)
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env
+}
+
+func TestArchiveRulesReproducible(t *testing.T) {
+	type archiveRule interface {
+		build(ctx context.Context, env *env, opts *buildOpts) error
+	}
+
+	files := map[string]string{
+		"p/a.txt":   "a",
+		"p/sub/b.x": "b",
+	}
+	env := newTestArchiveEnv(t, files)
+	input := []string{"a.txt", "sub/b.x"}
+
+	var rules []archiveRule
+	var outs []string
+	for _, compress := range []string{"", "gzip", "zstd"} {
+		name := "pack"
+		if compress != "" {
+			name += "-" + compress
+		}
+		r, err := newTar(env, "p", &Tar{
+			Name:        name,
+			Input:       input,
+			StripPrefix: ".",
+			AddPrefix:   "pack",
+			Compress:    compress,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+		outs = append(outs, r.out)
+	}
+	z, err := newZip(env, "p", &Zip{
+		Name:        "pack",
+		Input:       input,
+		StripPrefix: ".",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = append(rules, z)
+	outs = append(outs, z.out)
+
+	ctx := context.Background()
+	build := func() [][]byte {
+		var ret [][]byte
+		for i, r := range rules {
+			if err := r.build(ctx, env, &buildOpts{}); err != nil {
+				t.Fatalf("build %q: %s", outs[i], err)
+			}
+			bs, err := os.ReadFile(env.out(outs[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, bs)
+		}
+		return ret
+	}
+
+	first := build()
+
+	// Rebuild in a later second, with the input files touched. Neither
+	// should change the outputs.
+	time.Sleep(time.Second)
+	tm := time.Now().Add(time.Hour)
+	for name := range files {
+		if err := os.Chtimes(env.src(name), tm, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	second := build()
+	for i, out := range outs {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Errorf("outputs of %q are different", out)
+		}
+	}
+}
+
+func TestNewArchiveFilesAddPrefix(t *testing.T) {
+	for _, test := range []struct {
+		add, want string
+	}{
+		{"", ""},
+		{"pack", "pack"},
+		{"pack/", "pack"},
+		{"a/../b", "b"},
+		{"a/..", "."},
+		{"..a", "..a"},
+	} {
+		files, err := newArchiveFiles("p", nil, "", test.add, "")
+		if err != nil {
+			t.Errorf("add prefix %q: %s", test.add, err)
+			continue
+		}
+		if files.addPrefix != test.want {
+			t.Errorf(
+				"add prefix %q, got %q, want %q",
+				test.add, files.addPrefix, test.want,
+			)
+		}
+	}
+
+	for _, add := range []string{"/pack", "..", "../pack", "a/../../b"} {
+		_, err := newArchiveFiles("p", nil, "", add, "")
+		if !errcode.IsInvalidArg(err) {
+			t.Errorf("add prefix %q, got error %v, want invalid", add, err)
+		}
+	}
+}
@@ -16,6 +16,8 @@
 package caco3
 
 import (
+	"sort"
+	"sync"
 	"time"
 
 	"shanhu.io/misc/errcode"
@@ -25,9 +27,17 @@ import (
 	_ "modernc.org/sqlite" // sqlite db driver
 )
 
+// cacheFileName is the name of the build cache file in the output
+// directory.
+const cacheFileName = "CACHE"
+
 type buildCache struct {
+	mu sync.Mutex // sqlite does not like concurrent writes.
+
 	tables *pisces.Tables
 	cache  *pisces.KV
+	stats  *pisces.KV // File content hashes, keyed by file.
+	nodes  *pisces.KV // Node records, keyed by node name.
 	expire time.Duration
 	clock  func() time.Time
 }
@@ -39,6 +49,8 @@ func newBuildCache(f string) (*buildCache, error) {
 	}
 
 	cache := tables.NewKV("build_cache")
+	stats := tables.NewKV("stat_cache")
+	nodes := tables.NewKV("node_records")
 	if err := tables.CreateMissing(); err != nil {
 		return nil, errcode.Annotate(err, "create cache tables")
 	}
@@ -47,6 +59,8 @@ func newBuildCache(f string) (*buildCache, error) {
 		expire: time.Hour * 24 * 7,
 		tables: tables,
 		cache:  cache,
+		stats:  stats,
+		nodes:  nodes,
 	}, nil
 }
 
@@ -54,14 +68,19 @@ type buildCacheEntry struct {
 	Key        string              `json:"K"`
 	CreateTime *timeutil.Timestamp `json:"T"`
 	Built      *built              `json:"B"`
+	Action     *buildAction        `json:"A,omitempty"`
 }
 
-func (c *buildCache) put(k string, out *built) error {
+func (c *buildCache) put(k string, out *built, action *buildAction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	t := timeutil.ReadTime(c.clock)
 	entry := &buildCacheEntry{
 		Key:        k,
 		Built:      out,
 		CreateTime: timeutil.NewTimestamp(t),
+		Action:     action,
 	}
 	return c.cache.Replace(k, entry)
 }
@@ -69,6 +88,9 @@ func (c *buildCache) put(k string, out *built) error {
 var errNotFoundInCache = errcode.NotFoundf("not found in cache")
 
 func (c *buildCache) get(k string) (*built, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	entry := new(buildCacheEntry)
 	if err := c.cache.Get(k, entry); err != nil {
 		if errcode.IsNotFound(err) {
@@ -77,15 +99,36 @@ func (c *buildCache) get(k string) (*built, error) {
 		return nil, errcode.Annotate(err, "get from cache")
 	}
 
+	if c.expired(entry) {
+		return nil, errNotFoundInCache
+	}
+	return entry.Built, nil
+}
+
+func (c *buildCache) expired(entry *buildCacheEntry) bool {
 	now := timeutil.ReadTime(c.clock)
 	expire := timeutil.Time(entry.CreateTime).Add(c.expire)
-	if now.Before(expire) {
-		return entry.Built, nil
+	return !now.Before(expire)
+}
+
+// walk iterates through all entries in the cache.
+func (c *buildCache) walk(f func(entry *buildCacheEntry) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it := &pisces.Iter{
+		Make: func() interface{} { return new(buildCacheEntry) },
+		Do: func(_ string, v interface{}) error {
+			return f(v.(*buildCacheEntry))
+		},
 	}
-	return nil, errNotFoundInCache
+	return c.cache.Walk(it)
 }
 
 func (c *buildCache) remove(k string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if err := c.cache.Remove(k); err != nil {
 		if errcode.IsNotFound(err) {
 			return nil
@@ -94,3 +137,157 @@ func (c *buildCache) remove(k string) error {
 	}
 	return nil
 }
+
+func (c *buildCache) getFileHash(k string) (*fileHashEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := new(fileHashEntry)
+	if err := c.stats.Get(k, entry); err != nil {
+		if errcode.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (c *buildCache) putFileHash(k string, entry *fileHashEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats.Replace(k, entry)
+}
+
+// nodeRecords saves the records of a node's latest two distinct digests.
+type nodeRecords struct {
+	Name string      `json:"N"`
+	Cur  *nodeRecord `json:"C"`
+	Prev *nodeRecord `json:"P,omitempty"`
+}
+
+func (c *buildCache) getRecords(name string) (*nodeRecords, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	recs := new(nodeRecords)
+	if err := c.nodes.Get(name, recs); err != nil {
+		if errcode.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return recs, nil
+}
+
+// putRecord saves rec as the current record of node name. If the digest
+// changes, the current record becomes the previous one.
+func (c *buildCache) putRecord(name string, rec *nodeRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	recs := new(nodeRecords)
+	if err := c.nodes.Get(name, recs); err != nil {
+		if !errcode.IsNotFound(err) {
+			return err
+		}
+	} else if recs.Cur != nil && recs.Cur.Digest == rec.Digest {
+		return nil
+	}
+	recs.Name = name
+	recs.Prev = recs.Cur
+	recs.Cur = rec
+	return c.nodes.Replace(name, recs)
+}
+
+// pruneRecords removes the node records of digests that are not in live,
+// the digests that still have build cache entries. It returns the names of
+// the nodes that have no records left.
+func (c *buildCache) pruneRecords(live map[string]bool, dryRun bool) (
+	[]string, error,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed []string
+	changed := make(map[string]*nodeRecords)
+	it := &pisces.Iter{
+		Make: func() interface{} { return new(nodeRecords) },
+		Do: func(_ string, v interface{}) error {
+			recs := v.(*nodeRecords)
+			if recs.Name == "" {
+				return errcode.Internalf("node records have no name")
+			}
+			cur, prev := recs.Cur, recs.Prev
+			if recs.Prev != nil && !live[recs.Prev.Digest] {
+				recs.Prev = nil
+			}
+			if recs.Cur != nil && !live[recs.Cur.Digest] {
+				recs.Cur, recs.Prev = recs.Prev, nil
+			}
+			if recs.Cur == nil {
+				removed = append(removed, recs.Name)
+			} else if recs.Cur != cur || recs.Prev != prev {
+				changed[recs.Name] = recs
+			}
+			return nil
+		},
+	}
+	if err := c.nodes.Walk(it); err != nil {
+		return nil, errcode.Annotate(err, "walk node records")
+	}
+	sort.Strings(removed)
+	if dryRun {
+		return removed, nil
+	}
+
+	for _, name := range removed {
+		if err := c.nodes.Remove(name); err != nil {
+			return nil, errcode.Annotatef(err, "remove records of %q", name)
+		}
+	}
+	for name, recs := range changed {
+		if err := c.nodes.Replace(name, recs); err != nil {
+			return nil, errcode.Annotatef(err, "save records of %q", name)
+		}
+	}
+	return removed, nil
+}
+
+// pruneFileHashes removes the content hashes of the files that keep
+// returns false for. It returns the keys of the removed hashes.
+func (c *buildCache) pruneFileHashes(
+	keep func(key string) bool, dryRun bool,
+) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var removed []string
+	it := &pisces.Iter{
+		Make: func() interface{} { return new(fileHashEntry) },
+		Do: func(_ string, v interface{}) error {
+			entry := v.(*fileHashEntry)
+			if entry.Key == "" {
+				return errcode.Internalf("stat cache entry has no key")
+			}
+			if !keep(entry.Key) {
+				removed = append(removed, entry.Key)
+			}
+			return nil
+		},
+	}
+	if err := c.stats.Walk(it); err != nil {
+		return nil, errcode.Annotate(err, "walk stat cache")
+	}
+	sort.Strings(removed)
+	if dryRun {
+		return removed, nil
+	}
+
+	for _, k := range removed {
+		if err := c.stats.Remove(k); err != nil {
+			return nil, errcode.Annotatef(err, "remove %q", k)
+		}
+	}
+	return removed, nil
+}
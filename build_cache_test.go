@@ -0,0 +1,126 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildCachePruneRecords(t *testing.T) {
+	cache, err := newBuildCache(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(name string, digests ...string) {
+		for _, d := range digests {
+			rec := &nodeRecord{Digest: d}
+			if err := cache.putRecord(name, rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put("a", "a1", "a2")
+	put("b", "b1", "b2")
+	put("c", "c1", "c2")
+	put("d", "d1")
+
+	live := map[string]bool{"a1": true, "a2": true, "b1": true, "c2": true}
+	for _, dryRun := range []bool{true, false} {
+		removed, err := cache.pruneRecords(live, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"d"}; !reflect.DeepEqual(removed, want) {
+			t.Errorf("dry run %t: removed %q, want %q", dryRun, removed, want)
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		cur, prev string // Empty for no records.
+	}{
+		{"a", "a2", "a1"},
+		{"b", "b1", ""},
+		{"c", "c2", ""},
+		{"d", "", ""},
+	} {
+		recs, err := cache.getRecords(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cur, prev string
+		if recs != nil && recs.Cur != nil {
+			cur = recs.Cur.Digest
+		}
+		if recs != nil && recs.Prev != nil {
+			prev = recs.Prev.Digest
+		}
+		if cur != test.cur || prev != test.prev {
+			t.Errorf(
+				"records of %q: got %q, %q, want %q, %q",
+				test.name, cur, prev, test.cur, test.prev,
+			)
+		}
+	}
+}
+
+func TestBuildCachePruneFileHashes(t *testing.T) {
+	cache, err := newBuildCache(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"s:p/a.go", "s:p/b.go", "o:p/c"} {
+		entry := &fileHashEntry{Key: k, Sha256: "sum"}
+		if err := cache.putFileHash(k, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := func(k string) bool { return k != "s:p/b.go" }
+	for _, dryRun := range []bool{true, false} {
+		removed, err := cache.pruneFileHashes(keep, dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"s:p/b.go"}; !reflect.DeepEqual(removed, want) {
+			t.Errorf("dry run %t: removed %q, want %q", dryRun, removed, want)
+		}
+	}
+
+	for _, test := range []struct {
+		key  string
+		want bool
+	}{
+		{"s:p/a.go", true},
+		{"s:p/b.go", false},
+		{"o:p/c", true},
+	} {
+		entry, err := cache.getFileHash(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entry != nil; got != test.want {
+			t.Errorf(
+				"%q in stat cache: got %t, want %t",
+				test.key, got, test.want,
+			)
+		}
+	}
+}
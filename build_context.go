@@ -15,14 +15,177 @@
 
 package caco3
 
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+// buildTask is the build of a single node. Concurrent builders of the
+// same node wait on done and share the result.
+type buildTask struct {
+	done   chan struct{}
+	digest string
+	err    error
+}
+
 type buildContext struct {
-	nodes map[string]*buildNode
+	ctx    context.Context // Canceled when the build aborts.
+	cancel context.CancelFunc
+	nodes  map[string]*buildNode
+
+	mu    sync.Mutex
+	built map[string]*buildTask // mapping to tasks, which has digests
+
+	// Ids of the idle workers. Limits the number of nodes building at
+	// once.
+	jobs chan int
+
+	keepGoing bool
+	failed    map[string]*lexing.Error // Errors of the failed nodes.
+	abort     bool                     // A node failed without keepGoing.
+
+	cache   *buildCache
+	records map[string]*nodeRecord // Saved after the build.
+
+	cas    *localCAS    // Optional local content-addressed store.
+	remote *remoteCache // Optional remote cache.
+
+	observers []BuildObserver
+	tracer    *buildTracer // Optional tracer.
+}
 
-	built map[string]string // mapping to digests
+func newBuildContext(
+	ctx context.Context, nodes map[string]*buildNode, cache *buildCache,
+	opts *buildOpts,
+) *buildContext {
+	jobs := opts.jobs
+	if jobs <= 0 {
+		jobs = 1
+	}
+	workers := make(chan int, jobs)
+	for i := 1; i <= jobs; i++ {
+		workers <- i
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &buildContext{
+		ctx:       ctx,
+		cancel:    cancel,
+		nodes:     nodes,
+		built:     make(map[string]*buildTask),
+		jobs:      workers,
+		keepGoing: opts.keepGoing,
+		failed:    make(map[string]*lexing.Error),
+		cache:     cache,
+		records:   make(map[string]*nodeRecord),
+	}
+}
+
+var (
+	// errDepFailed is returned for a node that is not built because one
+	// of its dependencies failed. The failure is only reported on the
+	// dependency.
+	errDepFailed = errcode.Internalf("dependency failed")
+
+	// errBuildAborted is returned for a node that is not built because
+	// some other node failed and the build is not keeping going.
+	errBuildAborted = errcode.Internalf("build aborted")
+)
+
+// fail records the failure of node n. Without keepGoing, the first
+// failure aborts the build, and cancels the nodes that are building.
+func (c *buildContext) fail(n *buildNode, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.abort && isCanceled(err) {
+		return // Canceled by the abort; not a failure of its own.
+	}
+	c.failed[n.name] = &lexing.Error{Pos: n.pos, Err: err}
+	if !c.keepGoing && !c.abort {
+		c.abort = true
+		c.cancel()
+	}
+}
 
-	cache *buildCache
+// aborted returns true if the build should not start building any
+// more nodes.
+func (c *buildContext) aborted() bool {
+	return c.ctx.Err() != nil
 }
 
+// errs returns the errors of all failed nodes, sorted by node name.
+func (c *buildContext) errs() []*lexing.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.failed) == 0 {
+		return nil
+	}
+	var names []string
+	for name := range c.failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []*lexing.Error
+	for _, name := range names {
+		errs = append(errs, c.failed[name])
+	}
+	return errs
+}
+
+// task returns the build task of node n. It returns true if the task is
+// newly created, and the caller is responsible for running it.
+func (c *buildContext) task(n string) (*buildTask, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.built[n]; ok {
+		return t, false
+	}
+	t := &buildTask{done: make(chan struct{})}
+	c.built[n] = t
+	return t, true
+}
+
+// addRecord adds the record of node n, which is saved after the build if
+// n is built.
+func (c *buildContext) addRecord(n string, rec *nodeRecord) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[n] = rec
+}
+
+// saveRecords saves the records of the nodes that are built without
+// errors.
+func (c *buildContext) saveRecords() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	for name := range c.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if t := c.built[name]; t == nil || t.err != nil {
+			continue
+		}
+		if err := c.cache.putRecord(name, c.records[name]); err != nil {
+			return errcode.Annotatef(err, "save record of %q", name)
+		}
+	}
+	return nil
+}
+
+// acquireJob waits for an idle worker, and returns its id.
+func (c *buildContext) acquireJob() int { return <-c.jobs }
+
+func (c *buildContext) releaseJob(worker int) { c.jobs <- worker }
+
 func (c *buildContext) nodeType(n string) string {
 	node, ok := c.nodes[n]
 	if !ok {
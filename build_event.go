@@ -0,0 +1,159 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Types of build events.
+const (
+	EventStarted   = "started"
+	EventCacheHit  = "cache_hit"
+	EventCacheMiss = "cache_miss"
+	EventFinished  = "finished"
+	EventFailed    = "failed"
+)
+
+// Caches that a cache hit can come from.
+const (
+	CacheBuild    = "build"     // The build cache; outputs are up to date.
+	CacheLocalCAS = "local_cas" // Restored from the local CAS.
+	CacheRemote   = "remote"    // Restored from the remote cache.
+)
+
+// BuildEvent is an event of a rule during a build.
+type BuildEvent struct {
+	Time     time.Time
+	Type     string
+	Rule     string
+	RuleType string
+
+	// Time since the rule started, in nanoseconds when encoded in JSON.
+	// Set on cache hits, finished and failed events.
+	Duration time.Duration `json:",omitempty"`
+
+	Cache string   `json:",omitempty"` // Set on cache hits.
+	Outs  []string `json:",omitempty"` // Outputs of the rule.
+	Error string   `json:",omitempty"` // Set on failed events.
+}
+
+// BuildObserver observes build events. Events of different rules might
+// be sent concurrently.
+type BuildObserver interface {
+	OnBuildEvent(e *BuildEvent)
+}
+
+// JSONEventWriter is a build observer that writes build events as JSON
+// lines.
+type JSONEventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONEventWriter creates a build observer that writes events into w,
+// one JSON object per line.
+func NewJSONEventWriter(w io.Writer) *JSONEventWriter {
+	return &JSONEventWriter{enc: json.NewEncoder(w)}
+}
+
+// OnBuildEvent writes the event. After the first write error, events are
+// dropped.
+func (w *JSONEventWriter) OnBuildEvent(e *BuildEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return
+	}
+	w.err = w.enc.Encode(e)
+}
+
+// Err returns the first write error.
+func (w *JSONEventWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// ruleEvents sends the events of a rule node to the observers.
+type ruleEvents struct {
+	observers []BuildObserver
+	node      *buildNode
+	start     time.Time
+}
+
+func newRuleEvents(obs []BuildObserver, n *buildNode) *ruleEvents {
+	return &ruleEvents{
+		observers: obs,
+		node:      n,
+		start:     time.Now(),
+	}
+}
+
+func (r *ruleEvents) emit(e *BuildEvent) {
+	if len(r.observers) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	e.Rule = r.node.name
+	e.RuleType = r.node.ruleType
+	for _, o := range r.observers {
+		o.OnBuildEvent(e)
+	}
+}
+
+func (r *ruleEvents) outs() []string {
+	if m := r.node.ruleMeta; m != nil {
+		return m.outs
+	}
+	return nil
+}
+
+func (r *ruleEvents) started() { r.emit(&BuildEvent{Type: EventStarted}) }
+
+func (r *ruleEvents) cacheMiss() {
+	r.emit(&BuildEvent{Type: EventCacheMiss})
+}
+
+func (r *ruleEvents) cacheHit(cache string) {
+	r.emit(&BuildEvent{
+		Type:     EventCacheHit,
+		Duration: time.Since(r.start),
+		Cache:    cache,
+		Outs:     r.outs(),
+	})
+}
+
+func (r *ruleEvents) finished() {
+	r.emit(&BuildEvent{
+		Type:     EventFinished,
+		Duration: time.Since(r.start),
+		Outs:     r.outs(),
+	})
+}
+
+func (r *ruleEvents) failed(err error) {
+	r.emit(&BuildEvent{
+		Type:     EventFailed,
+		Duration: time.Since(r.start),
+		Error:    err.Error(),
+	})
+}
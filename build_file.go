@@ -39,6 +39,22 @@ func makeBuildFileNode(t string) interface{} {
 		return new(DockerRun)
 	case ruleDownload:
 		return new(Download)
+	case ruleExec:
+		return new(Exec)
+	case ruleGoBinary:
+		return new(GoBinary)
+	case ruleGoTest:
+		return new(GoTest)
+	case ruleNpmBuild:
+		return new(NpmBuild)
+	case ruleTar:
+		return new(Tar)
+	case ruleZip:
+		return new(Zip)
+	case entryPackage:
+		return new(Package)
+	case entryVars:
+		return new(Vars)
 	}
 	return nil
 }
@@ -66,15 +82,56 @@ func readBuildFile(env *env, p string) ([]*buildNode, []*lexing.Error) {
 
 	errList := lexing.NewErrorList()
 
+	var pkg *Package
+	fileVars := make(map[string]string)
 	for _, r := range rules {
+		switch v := r.V.(type) {
+		case *Package:
+			if pkg != nil {
+				errList.Errorf(r.Pos, "package redeclared")
+				continue
+			}
+			pkg = v
+		case *Vars:
+			if err := mergeVars(fileVars, *v); err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+			}
+		}
+	}
+	vars := make(map[string]string)
+	if env.workspace != nil {
+		for k, v := range env.workspace.Vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range fileVars {
+		vars[k] = v
+	}
+	var defaultVis []string
+	if pkg != nil {
+		defaultVis = pkg.DefaultVisibility
+	}
+
+	for _, r := range rules {
+		switch r.V.(type) {
+		case *Package, *Vars:
+			continue
+		}
+
 		node := &buildNode{
 			typ:      nodeRule,
 			pos:      r.Pos,
 			ruleType: r.Type,
+			def:      r.V,
+			pkg:      p,
 		}
 
+		node.vars = expandVars(r.V, vars)
+
+		var vis []string
 		switch v := r.V.(type) {
 		case *FileSet:
+			vis = v.Visibility
 			fset, err := newFileSet(env, p, v)
 			if err != nil {
 				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
@@ -82,6 +139,7 @@ func readBuildFile(env *env, p string) ([]*buildNode, []*lexing.Error) {
 			}
 			node.rule = fset
 		case *DockerPull:
+			vis = v.Visibility
 			dp, err := newDockerPull(env, p, v)
 			if err != nil {
 				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
@@ -89,6 +147,7 @@ func readBuildFile(env *env, p string) ([]*buildNode, []*lexing.Error) {
 			}
 			node.rule = dp
 		case *DockerBuild:
+			vis = v.Visibility
 			db, err := newDockerBuild(env, p, v)
 			if err != nil {
 				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
@@ -96,21 +155,86 @@ func readBuildFile(env *env, p string) ([]*buildNode, []*lexing.Error) {
 			}
 			node.rule = db
 		case *DockerRun:
-			node.rule = newDockerRun(env, p, v)
+			vis = v.Visibility
+			dr, err := newDockerRun(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = dr
 		case *Download:
+			vis = v.Visibility
 			d, err := newDownload(env, p, v)
 			if err != nil {
 				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
 				continue
 			}
 			node.rule = d
+		case *Exec:
+			vis = v.Visibility
+			e, err := newExec(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = e
+		case *GoBinary:
+			vis = v.Visibility
+			gb, err := newGoBinary(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = gb
+		case *GoTest:
+			vis = v.Visibility
+			gt, err := newGoTest(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = gt
+		case *NpmBuild:
+			vis = v.Visibility
+			nb, err := newNpmBuild(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = nb
+		case *Tar:
+			vis = v.Visibility
+			t, err := newTar(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = t
+		case *Zip:
+			vis = v.Visibility
+			z, err := newZip(env, p, v)
+			if err != nil {
+				errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+				continue
+			}
+			node.rule = z
 		case *Bundle:
+			vis = v.Visibility
 			node.rule = newBundle(env, p, v)
 		default:
 			errList.Errorf(r.Pos, "unknown type: %q", r.Type)
 			continue
 		}
 
+		if len(vis) == 0 {
+			vis = defaultVis
+		}
+		if err := checkVisibility(vis); err != nil {
+			errList.Add(&lexing.Error{Pos: r.Pos, Err: err})
+			continue
+		}
+		node.visibility = vis
+
 		if node.rule != nil {
 			meta, err := node.rule.meta(env)
 			if err != nil {
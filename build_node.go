@@ -35,6 +35,13 @@ type buildNode struct {
 	ruleType string
 	rule     buildRule
 	ruleMeta *buildRuleMeta
+
+	def interface{} // Rule definition as in the build file.
+
+	pkg        string   // Package of the build file that declares the node.
+	visibility []string // Packages that can depend on the node.
+
+	vars map[string]string // Variables referenced in the rule definition.
 }
 
 func (n *buildNode) mainOut() string {
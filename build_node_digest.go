@@ -16,21 +16,35 @@
 package caco3
 
 import (
+	"encoding/json"
+
 	"shanhu.io/misc/errcode"
 )
 
-func buildNodeDigest(
+// nodeRecord records the digest of a node and what the digest is made from,
+// so that the changes of a node can be explained.
+type nodeRecord struct {
+	Digest string          `json:"D"`
+	Action *buildAction    `json:"A,omitempty"` // For rules and outputs.
+	Stat   *fileStat       `json:"S,omitempty"` // For source files.
+	Def    json.RawMessage `json:"R,omitempty"` // Rule definition.
+}
+
+// newNodeRecord creates the record of a node, where deps are the digests of
+// the dependencies. It returns nil if the node always needs re-execution.
+func newNodeRecord(
 	env *env, n *buildNode, deps map[string]string,
-) (string, error) {
+) (*nodeRecord, error) {
 	switch n.typ {
 	case nodeRule:
 		action := &buildAction{
 			Deps:     deps,
 			RuleType: n.ruleType,
+			Vars:     n.vars,
 		}
 		if meta := n.ruleMeta; meta != nil {
 			if meta.digest == "" {
-				return "", nil
+				return nil, nil
 			}
 			action.Rule = meta.digest
 			action.Outs = meta.outs
@@ -38,19 +52,32 @@ func buildNodeDigest(
 		}
 		d, err := makeDigest("build_action", "", action)
 		if err != nil {
-			return "", errcode.Annotate(err, "digest build action")
+			return nil, errcode.Annotate(err, "digest build action")
 		}
-		return d, nil
+		rec := &nodeRecord{Digest: d, Action: action}
+		if n.def != nil {
+			def, err := json.Marshal(n.def)
+			if err != nil {
+				return nil, errcode.Annotate(err, "marshal rule")
+			}
+			rec.Def = def
+		}
+		return rec, nil
 	case nodeSrc:
 		stat, err := newSrcFileStat(env, n.name)
 		if err != nil {
-			return "", errcode.Annotatef(err, "stat file %q", n.name)
+			return nil, errcode.Annotatef(err, "stat file %q", n.name)
+		}
+		if stat.Sha256 != "" {
+			// Content is hashed, so the file is the same no matter
+			// when it is touched, checked out or cloned.
+			stat.ModTimestamp = 0
 		}
 		d, err := makeDigest("src", "", stat)
 		if err != nil {
-			return "", errcode.Annotate(err, "digest source file")
+			return nil, errcode.Annotate(err, "digest source file")
 		}
-		return d, nil
+		return &nodeRecord{Digest: d, Stat: stat}, nil
 	case nodeOut:
 		action := &buildAction{
 			Deps:     deps,
@@ -58,10 +85,10 @@ func buildNodeDigest(
 		}
 		d, err := makeDigest("out", "", action)
 		if err != nil {
-			return "", errcode.Annotate(err, "digest output-of")
+			return nil, errcode.Annotate(err, "digest output-of")
 		}
-		return d, nil
+		return &nodeRecord{Digest: d, Action: action}, nil
 	default:
-		return "", nil
+		return nil, nil
 	}
 }
@@ -28,4 +28,18 @@ type buildOpts struct {
 	docker *dockerOpts
 
 	alwaysRebuild bool
+
+	jobs      int  // Number of nodes to build concurrently.
+	keepGoing bool // Keep building after a node fails.
+
+	contentHash bool // Digest file contents rather than timestamps.
+
+	localCAS    bool
+	localCASDir string // Directory of the local CAS; default is out/CAS.
+
+	remoteCache         string // URL of the remote cache server.
+	remoteCacheReadOnly bool
+
+	traceFile string     // File to write the Chrome trace into.
+	trace     *traceLane // Lane of the node being built; set per node.
 }
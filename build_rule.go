@@ -15,6 +15,10 @@
 
 package caco3
 
+import (
+	"context"
+)
+
 type buildRuleMeta struct {
 	name string
 	deps []string
@@ -22,6 +26,10 @@ type buildRuleMeta struct {
 
 	dockerOut bool // Output is a docker container image.
 
+	// dirOuts are the file set outputs that list the files of output
+	// directories. The listed files are also outputs of the rule.
+	dirOuts []string
+
 	// digest captures all non-dependency input such as action type, binded
 	// input, external input, etc.  returns empty string if this always needs
 	// re-execution.
@@ -32,6 +40,7 @@ type buildRule interface {
 	// meta returns meta information of a build rule.
 	meta(env *env) (*buildRuleMeta, error)
 
-	// build executes the build action.
-	build(env *env, opts *buildOpts) error
+	// build executes the build action. It should stop and return early
+	// when ctx ends.
+	build(ctx context.Context, env *env, opts *buildOpts) error
 }
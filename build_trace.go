@@ -0,0 +1,132 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"shanhu.io/misc/jsonutil"
+)
+
+// traceEvent is an event in Chrome's trace event format.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat,omitempty"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"` // In microseconds.
+	Dur  int64             `json:"dur"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+type traceFile struct {
+	TraceEvents     []*traceEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// buildTracer records the spans of a build. Each worker that builds nodes
+// has its own lane, which is a thread in the trace.
+type buildTracer struct {
+	start time.Time
+
+	mu      sync.Mutex
+	events  []*traceEvent
+	workers map[int]bool
+}
+
+func newBuildTracer() *buildTracer {
+	return &buildTracer{
+		start:   time.Now(),
+		workers: make(map[int]bool),
+	}
+}
+
+func (t *buildTracer) add(e *traceEvent, worker int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, e)
+	t.workers[worker] = true
+}
+
+// lane returns the lane of a worker that builds node n. It returns nil
+// when t is nil.
+func (t *buildTracer) lane(worker int, n *buildNode) *traceLane {
+	if t == nil {
+		return nil
+	}
+	return &traceLane{tracer: t, worker: worker, node: n.name}
+}
+
+func (t *buildTracer) writeFile(f string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var workers []int
+	for w := range t.workers {
+		workers = append(workers, w)
+	}
+	sort.Ints(workers)
+
+	var events []*traceEvent
+	for _, w := range workers {
+		events = append(events, &traceEvent{
+			Name: "thread_name",
+			Ph:   "M",
+			Pid:  1,
+			Tid:  w,
+			Args: map[string]string{"name": fmt.Sprintf("worker %d", w)},
+		})
+	}
+	events = append(events, t.events...)
+
+	return jsonutil.WriteFile(f, &traceFile{
+		TraceEvents:     events,
+		DisplayTimeUnit: "ms",
+	})
+}
+
+// traceLane records spans of a node on the lane of a worker. All methods
+// are no-op on a nil lane.
+type traceLane struct {
+	tracer *buildTracer
+	worker int
+	node   string
+}
+
+// span starts a span, and returns a function that ends the span.
+func (l *traceLane) span(name, cat string) func() {
+	if l == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		t := l.tracer
+		t.add(&traceEvent{
+			Name: name,
+			Cat:  cat,
+			Ph:   "X",
+			Ts:   start.Sub(t.start).Microseconds(),
+			Dur:  time.Since(start).Microseconds(),
+			Pid:  1,
+			Tid:  l.worker,
+			Args: map[string]string{"node": l.node},
+		}, l.worker)
+	}
+}
@@ -16,11 +16,13 @@
 package caco3
 
 import (
+	"context"
 	"errors"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"shanhu.io/misc/errcode"
 	"shanhu.io/misc/osutil"
@@ -35,12 +37,49 @@ type Config struct {
 	AlwaysRebuild bool // Always rebuild everything.
 
 	UseDockerBuildCache bool // Use docker build cache.
+
+	// Number of rules to build concurrently. 0 means 1, which builds
+	// rules one at a time.
+	Jobs int
+
+	// Keep building everything that does not depend on a failed rule,
+	// and report all the failures at the end.
+	KeepGoing bool
+
+	// Use the sha256 of file contents rather than file timestamps to
+	// detect changes. Hashes are saved in a stat cache, so unchanged files
+	// are not hashed again.
+	ContentHash bool
+
+	// Keep a copy of every output file in a local content-addressed store,
+	// and restore outputs from the store rather than rebuilding them when
+	// they are deleted or overwritten. File contents are always hashed when
+	// this is enabled.
+	LocalCAS bool
+
+	// Directory of the local content-addressed store. Default is CAS under
+	// the output directory.
+	LocalCASDir string
+
+	// URL of a remote HTTP build cache server. When set, file contents are
+	// always hashed, and outputs of rules that are not container images are
+	// shared through the remote cache.
+	RemoteCache string
+
+	// Only read from the remote cache; do not upload build results.
+	RemoteCacheReadOnly bool
+
+	// File to write a trace of the build into, in Chrome's trace event
+	// format. It can be loaded in chrome://tracing or Perfetto.
+	Trace string
 }
 
 // Builder builds stuff.
 type Builder struct {
 	env  *env
 	opts *buildOpts
+
+	observers []BuildObserver
 }
 
 const workspaceFile = "WORKSPACE.caco3"
@@ -89,15 +128,26 @@ func NewBuilder(workDir string, config *Config) (*Builder, error) {
 
 	env := &env{
 		dock:        dock.NewUnixClient(""),
+		docker:      newDockerAPI(""),
 		rootDir:     root,
 		workDir:     workDir,
 		workSrcPath: workSrcPath,
 		srcDir:      srcDir,
 		outDir:      filepath.Join(root, "out"),
+		goHostEnvs:  newGoHostEnvs(),
 	}
 	opts := &buildOpts{
 		log:           os.Stderr,
 		alwaysRebuild: config.AlwaysRebuild,
+		jobs:          config.Jobs,
+		keepGoing:     config.KeepGoing,
+		contentHash:   config.ContentHash,
+		localCAS:      config.LocalCAS,
+		localCASDir:   config.LocalCASDir,
+
+		remoteCache:         config.RemoteCache,
+		remoteCacheReadOnly: config.RemoteCacheReadOnly,
+		traceFile:           config.Trace,
 		docker: &dockerOpts{
 			useBuildCache: config.UseDockerBuildCache,
 		},
@@ -122,6 +172,12 @@ func (b *Builder) ReadWorkspace() (*Workspace, []*lexing.Error) {
 	return ws, nil
 }
 
+// AddObserver adds an observer that receives the events of the rules
+// in later builds.
+func (b *Builder) AddObserver(o BuildObserver) {
+	b.observers = append(b.observers, o)
+}
+
 // Src returns the filesystem path to a source file.
 func (b *Builder) Src(f string) string { return b.env.src(f) }
 
@@ -136,37 +192,91 @@ func (b *Builder) SyncRepos(sums *RepoSums, opts *SyncOptions) (
 	return syncRepos(b.env, sums, opts)
 }
 
-// Build builds the given rules.
-func (b *Builder) Build(rules []string) []*lexing.Error {
-	if w := b.env.workSrcPath; w != "" {
-		var absPaths []string
-		for _, r := range rules {
-			p := makePath(w, r)
-			absPaths = append(absPaths, p)
-		}
-		rules = absPaths
+// absRules makes rule names and target patterns relative to the work
+// directory absolute.
+func (b *Builder) absRules(rules []string) []string {
+	w := b.env.workSrcPath
+	if w == "" {
+		return rules
 	}
-
-	nodes, nodeMap, errs := loadNodes(b.env, rules)
-	if errs != nil {
-		return errs
+	var absPaths []string
+	for _, r := range rules {
+		absPaths = append(absPaths, absPattern(w, r))
 	}
-	cacheFile, err := b.env.prepareOut("CACHE")
+	return absPaths
+}
+
+func (b *Builder) openCache() (*buildCache, error) {
+	cacheFile, err := b.env.prepareOut(cacheFileName)
 	if err != nil {
-		return lexing.SingleErr(errcode.Annotate(err, "prepare CACHE"))
+		return nil, errcode.Annotate(err, "prepare CACHE")
 	}
 	cache, err := newBuildCache(cacheFile)
 	if err != nil {
-		err := errcode.Annotate(err, "create build cache")
+		return nil, errcode.Annotate(err, "create build cache")
+	}
+	return cache, nil
+}
+
+func (b *Builder) casDir() string {
+	if dir := b.opts.localCASDir; dir != "" {
+		return dir
+	}
+	return b.env.out(casDirName)
+}
+
+// setupHasher enables content hashing if any option requires it.
+func (b *Builder) setupHasher(cache *buildCache) {
+	o := b.opts
+	if o.contentHash || o.localCAS || o.remoteCache != "" {
+		b.env.hasher = newFileHasher(cache)
+	}
+}
+
+// Build builds the given rules. When ctx ends, running rules are stopped,
+// and their partially written outputs are removed.
+func (b *Builder) Build(ctx context.Context, rules []string) []*lexing.Error {
+	nodes, nodeMap, errs := loadNodes(b.env, b.absRules(rules))
+	if errs != nil {
+		return errs
+	}
+	cache, err := b.openCache()
+	if err != nil {
 		return lexing.SingleErr(err)
 	}
+	b.setupHasher(cache)
 
-	ctx := &buildContext{
-		nodes: nodeMap,
-		built: make(map[string]string),
-		cache: cache,
+	bctx := newBuildContext(ctx, nodeMap, cache, b.opts)
+	defer bctx.cancel()
+	bctx.observers = b.observers
+	if b.opts.traceFile != "" {
+		bctx.tracer = newBuildTracer()
+	}
+	if b.opts.localCAS {
+		bctx.cas = newLocalCAS(b.casDir())
+	}
+	if s := b.opts.remoteCache; s != "" {
+		remote, err := newRemoteCache(s, b.opts.remoteCacheReadOnly)
+		if err != nil {
+			err := errcode.Annotate(err, "create remote cache")
+			return lexing.SingleErr(err)
+		}
+		bctx.remote = remote
+	}
+	errs = b.buildNodes(bctx, nodes)
+	if err := bctx.saveRecords(); err != nil {
+		errs = append(errs, lexing.SingleErr(err)...)
+	}
+	if errs == nil && ctx.Err() != nil {
+		errs = lexing.SingleErr(errcode.Annotate(ctx.Err(), "build"))
 	}
-	return b.buildNodes(ctx, nodes)
+	if bctx.tracer != nil {
+		if err := bctx.tracer.writeFile(b.opts.traceFile); err != nil {
+			err := errcode.Annotate(err, "write trace")
+			errs = append(errs, lexing.SingleErr(err)...)
+		}
+	}
+	return errs
 }
 
 func (b *Builder) buildNodes(
@@ -175,83 +285,200 @@ func (b *Builder) buildNodes(
 	b.env.nodeType = ctx.nodeType
 	b.env.ruleType = ctx.ruleType
 
+	var wg sync.WaitGroup
 	for _, n := range nodes {
 		if n.typ == nodeSrc {
 			log.Printf("%s is a source file", n.name)
 			continue
 		}
-		if _, err := b.buildNode(ctx, n); err != nil {
-			return lexing.SingleErr(err)
-		}
+		wg.Add(1)
+		go func(n *buildNode) {
+			defer wg.Done()
+			b.buildNode(ctx, n) // Errors are collected in ctx.
+		}(n)
 	}
-	return nil
+	wg.Wait()
+
+	return ctx.errs()
 }
 
+// buildNode builds node n. It is safe to call concurrently; each node is
+// only built once, and later callers wait for the result.
 func (b *Builder) buildNode(ctx *buildContext, n *buildNode) (
 	string, error,
 ) {
-	if digest, ok := ctx.built[n.name]; ok {
-		return digest, nil
+	task, isNew := ctx.task(n.name)
+	if isNew {
+		task.digest, task.err = b.runBuildNode(ctx, n)
+		if err := task.err; err != nil {
+			if !errors.Is(err, errDepFailed) &&
+				!errors.Is(err, errBuildAborted) {
+				ctx.fail(n, err)
+			}
+		}
+		close(task.done)
+	} else {
+		<-task.done
 	}
-	digest := ""
-	defer func() { ctx.built[n.name] = digest }()
+	return task.digest, task.err
+}
 
-	deps := make(map[string]string)
-	for _, dep := range n.deps {
+// buildDeps builds all dependencies of n concurrently. It returns the
+// digests of the dependencies, or nil if any of the dependency is always
+// rebuilding.
+func (b *Builder) buildDeps(ctx *buildContext, n *buildNode) (
+	map[string]string, error,
+) {
+	depNodes := make([]*buildNode, len(n.deps))
+	for i, dep := range n.deps {
 		depNode := ctx.nodes[dep]
 		if depNode == nil {
-			return "", errcode.InvalidArgf(
+			return nil, errcode.InvalidArgf(
 				"dep %q for %q not found", dep, n.name,
 			)
 		}
-		d, err := b.buildNode(ctx, depNode)
+		depNodes[i] = depNode
+	}
+
+	digests := make([]string, len(depNodes))
+	errs := make([]error, len(depNodes))
+	var wg sync.WaitGroup
+	for i, depNode := range depNodes {
+		wg.Add(1)
+		go func(i int, depNode *buildNode) {
+			defer wg.Done()
+			digests[i], errs[i] = b.buildNode(ctx, depNode)
+		}(i, depNode)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if errors.Is(err, errBuildAborted) {
+			return nil, err
+		}
+	}
+	for _, err := range errs {
 		if err != nil {
-			return "", err
+			return nil, errDepFailed
 		}
+	}
+
+	deps := make(map[string]string)
+	for i, dep := range n.deps {
+		d := digests[i]
 		if d == "" {
 			// If any dep is always rebuilding, then this node
 			// is also always rebuilding.
-			deps = nil
-		} else if deps != nil {
-			deps[dep] = d
+			return nil, nil
 		}
+		deps[dep] = d
+	}
+	return deps, nil
+}
+
+func (b *Builder) runBuildNode(ctx *buildContext, n *buildNode) (
+	digest string, err error,
+) {
+	deps, err := b.buildDeps(ctx, n)
+	if err != nil {
+		return "", err
 	}
 
+	// All dependencies are ready; wait for a free job slot.
+	worker := ctx.acquireJob()
+	defer ctx.releaseJob(worker)
+
+	if ctx.aborted() {
+		return "", errBuildAborted
+	}
+
+	lane := ctx.tracer.lane(worker, n)
+	defer lane.span(n.name, n.typ)()
+
+	events := newRuleEvents(nil, n)
+	if n.typ == nodeRule {
+		events = newRuleEvents(ctx.observers, n)
+		events.started()
+		defer func() {
+			if err != nil {
+				events.failed(err)
+			}
+		}()
+	}
+
+	var action *buildAction
 	if deps != nil { // Not always rebuilding, so calculate the digest
-		d, err := buildNodeDigest(b.env, n, deps)
+		endSpan := lane.span("digest", "cache")
+		rec, err := newNodeRecord(b.env, n, deps)
+		endSpan()
 		if err != nil {
 			return "", errcode.Annotate(err, "digest")
 		}
-		digest = d
+		if rec != nil {
+			ctx.addRecord(n.name, rec)
+			digest = rec.Digest
+			action = rec.Action
+		}
 	}
 
 	outputChanged := true
+	var cached *built // Cached but outputs changed.
 	if digest != "" {
-		built, err := ctx.cache.get(digest)
+		endSpan := lane.span("cache lookup", "cache")
+		hit, c, err := b.lookupCache(ctx, digest)
+		endSpan()
 		if err != nil {
-			if !errors.Is(err, errNotFoundInCache) {
-				return "", errcode.Annotate(err, "check from build cache")
-			}
-		} else {
-			same, err := checkSameBuilt(b.env, built)
-			if err != nil {
-				return "", errcode.Annotate(err, "check built")
-			}
-			outputChanged = !same
+			return "", err
 		}
+		outputChanged = !hit
+		cached = c
 	}
 
 	// Build.
 	if !outputChanged && !b.opts.alwaysRebuild { // Cache hit.
+		events.cacheHit(CacheBuild)
 		return digest, nil
 	}
+	if cached != nil && ctx.cas != nil && !b.opts.alwaysRebuild {
+		endSpan := lane.span("restore from local cas", "cache")
+		hit, err := b.restoreLocal(ctx, n, digest, action, cached)
+		endSpan()
+		if err != nil {
+			log.Printf("local cas for %s: %s", n.name, err)
+		} else if hit {
+			events.cacheHit(CacheLocalCAS)
+			return digest, nil
+		}
+	}
 	if err := ctx.cache.remove(digest); err != nil {
 		return "", errcode.Annotate(err, "invalidate cache")
 	}
 
+	if digest != "" && !b.opts.alwaysRebuild && ctx.remote != nil &&
+		n.typ == nodeRule && n.ruleMeta != nil && !n.ruleMeta.dockerOut {
+		endSpan := lane.span("restore from remote cache", "cache")
+		hit, err := b.restoreRemote(ctx, n, digest, action)
+		endSpan()
+		if err != nil {
+			log.Printf("remote cache for %s: %s", n.name, err)
+		} else if hit {
+			events.cacheHit(CacheRemote)
+			return digest, nil
+		}
+	}
+
+	events.cacheMiss()
 	if n.typ == nodeRule && n.rule != nil {
 		log.Printf("BUILD %s", n.name)
-		if err := n.rule.build(b.env, b.opts); err != nil {
+		opts := *b.opts
+		opts.trace = lane
+		endSpan := lane.span("build", n.ruleType)
+		err := n.rule.build(ctx.ctx, b.env, &opts)
+		endSpan()
+		if err != nil {
+			if isCanceled(err) {
+				b.removeOuts(n)
+			}
 			return "", errcode.Annotatef(err, "build %s", n.name)
 		}
 
@@ -259,10 +486,129 @@ func (b *Builder) buildNode(ctx *buildContext, n *buildNode) (
 		if err != nil {
 			return "", errcode.Annotate(err, "make built")
 		}
-		if err := ctx.cache.put(digest, built); err != nil {
+		if err := ctx.cache.put(digest, built, action); err != nil {
 			return "", errcode.Annotate(err, "save in build cache")
 		}
+		if ctx.cas != nil {
+			if err := ctx.cas.put(b.env, built); err != nil {
+				log.Printf("save %s in local cas: %s", n.name, err)
+			}
+		}
+		if digest != "" && ctx.remote != nil {
+			err := ctx.remote.put(ctx.ctx, b.env, digest, built)
+			if err != nil {
+				log.Printf("upload %s to remote cache: %s", n.name, err)
+			}
+		}
 	}
+	events.finished()
 
 	return digest, nil
 }
+
+// removeOuts removes the output files of n, which might be partially
+// written.
+func (b *Builder) removeOuts(n *buildNode) {
+	for _, out := range n.ruleMeta.outs {
+		f := b.env.out(out)
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove %s: %s", out, err)
+		}
+	}
+	for _, out := range n.ruleMeta.dirOuts {
+		dir := b.env.out(strings.TrimSuffix(out, fileSetExt))
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("remove %s: %s", dir, err)
+		}
+	}
+}
+
+// lookupCache checks if digest is in the build cache and the outputs are
+// unchanged. When the outputs changed, it returns the cached build result.
+func (b *Builder) lookupCache(ctx *buildContext, digest string) (
+	bool, *built, error,
+) {
+	built, err := ctx.cache.get(digest)
+	if err != nil {
+		if errors.Is(err, errNotFoundInCache) {
+			return false, nil, nil
+		}
+		return false, nil, errcode.Annotate(err, "check from build cache")
+	}
+	same, err := checkSameBuilt(b.env, built)
+	if err != nil {
+		return false, nil, errcode.Annotate(err, "check built")
+	}
+	if !same {
+		return false, built, nil
+	}
+	return true, nil, nil
+}
+
+// restoreLocal tries to restore the outputs of n from the local
+// content-addressed store, where cached is the previous build result. It
+// returns true on a cache hit.
+func (b *Builder) restoreLocal(
+	ctx *buildContext, n *buildNode,
+	digest string, action *buildAction, cached *built,
+) (bool, error) {
+	ok, err := ctx.cas.restore(b.env, n.ruleMeta, cached)
+	if err != nil {
+		return false, errcode.Annotate(err, "restore outputs")
+	}
+	if !ok {
+		return false, nil
+	}
+
+	built, err := newBuilt(b.env, n.ruleMeta)
+	if err != nil {
+		return false, errcode.Annotate(err, "make built")
+	}
+	same, err := checkSameBuilt(b.env, built)
+	if err != nil {
+		return false, errcode.Annotate(err, "check built")
+	}
+	if !same { // Container images changed.
+		return false, nil
+	}
+
+	log.Printf("RESTORE %s", n.name)
+	if err := ctx.cache.put(digest, built, action); err != nil {
+		return false, errcode.Annotate(err, "save in build cache")
+	}
+	return true, nil
+}
+
+// restoreRemote tries to restore the outputs of n from the remote cache.
+// It returns true on a cache hit.
+func (b *Builder) restoreRemote(
+	ctx *buildContext, n *buildNode, digest string, action *buildAction,
+) (bool, error) {
+	remoteBuilt, err := ctx.remote.get(ctx.ctx, digest)
+	if err != nil {
+		if errors.Is(err, errNotFoundInCache) {
+			return false, nil
+		}
+		return false, errcode.Annotate(err, "check remote cache")
+	}
+	if err := ctx.remote.restore(
+		ctx.ctx, b.env, n.ruleMeta, remoteBuilt,
+	); err != nil {
+		return false, errcode.Annotate(err, "restore outputs")
+	}
+
+	log.Printf("RESTORE %s", n.name)
+	built, err := newBuilt(b.env, n.ruleMeta)
+	if err != nil {
+		return false, errcode.Annotate(err, "make built")
+	}
+	if err := ctx.cache.put(digest, built, action); err != nil {
+		return false, errcode.Annotate(err, "save in build cache")
+	}
+	if ctx.cas != nil {
+		if err := ctx.cas.put(b.env, built); err != nil {
+			log.Printf("save %s in local cas: %s", n.name, err)
+		}
+	}
+	return true, nil
+}
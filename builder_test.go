@@ -0,0 +1,295 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"shanhu.io/misc/errcode"
+)
+
+// fakeBuild records the fake rules built in a test.
+type fakeBuild struct {
+	mu         sync.Mutex
+	built      []string
+	canceled   []string
+	running    int
+	maxRunning int
+}
+
+func (b *fakeBuild) start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running++
+	if b.running > b.maxRunning {
+		b.maxRunning = b.running
+	}
+}
+
+func (b *fakeBuild) end(name string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running--
+	if err == nil {
+		b.built = append(b.built, name)
+	} else if isCanceled(err) {
+		b.canceled = append(b.canceled, name)
+	}
+}
+
+func (b *fakeBuild) sorted(names []string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ret := append([]string(nil), names...)
+	sort.Strings(ret)
+	return ret
+}
+
+// fakeRule is a rule that runs a function as its build action.
+type fakeRule struct {
+	name   string
+	b      *fakeBuild
+	run    func(ctx context.Context) error // Succeeds when nil.
+	digest string                          // Always rebuilds when empty.
+}
+
+func (r *fakeRule) meta(env *env) (*buildRuleMeta, error) {
+	return &buildRuleMeta{name: r.name, digest: r.digest}, nil
+}
+
+func (r *fakeRule) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	r.b.start()
+	var err error
+	if r.run != nil {
+		err = r.run(ctx)
+	}
+	r.b.end(r.name, err)
+	return err
+}
+
+func failRule(context.Context) error { return errcode.Internalf("fail") }
+
+func sleepRule(ctx context.Context) error {
+	select {
+	case <-time.After(10 * time.Millisecond):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// testBuild builds rules, where deps maps from rules to their
+// dependencies. It returns the names of the failed rules, and the build
+// cache.
+func testBuild(
+	t *testing.T, opts *buildOpts, rules []*fakeRule,
+	deps map[string][]string,
+) ([]string, *buildCache) {
+	t.Helper()
+
+	dir := t.TempDir()
+	cache, err := newBuildCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeMap := make(map[string]*buildNode)
+	var nodes []*buildNode
+	for _, r := range rules {
+		meta, err := r.meta(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &buildNode{
+			name:     r.name,
+			typ:      nodeRule,
+			deps:     deps[r.name],
+			ruleType: "fake",
+			rule:     r,
+			ruleMeta: meta,
+		}
+		nodeMap[n.name] = n
+		nodes = append(nodes, n)
+	}
+
+	b := &Builder{
+		env: &env{
+			srcDir: filepath.Join(dir, "src"),
+			outDir: filepath.Join(dir, "out"),
+		},
+		opts: opts,
+	}
+	ctx := newBuildContext(context.Background(), nodeMap, cache, opts)
+	defer ctx.cancel()
+
+	errs := b.buildNodes(ctx, nodes)
+	if err := ctx.saveRecords(); err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	for name, err := range ctx.failed {
+		if errors.Is(err.Err, errDepFailed) ||
+			errors.Is(err.Err, errBuildAborted) {
+			t.Errorf("%s: got %q, want a rule failure", name, err.Err)
+		}
+		failed = append(failed, name)
+	}
+	if len(errs) != len(failed) {
+		t.Errorf("got %d errors, want %d", len(errs), len(failed))
+	}
+	sort.Strings(failed)
+	return failed, cache
+}
+
+func TestBuildDepFailed(t *testing.T) {
+	b := new(fakeBuild)
+	rules := []*fakeRule{
+		{name: "a", b: b, run: failRule},
+		{name: "b", b: b},
+		{name: "c", b: b},
+		{name: "d", b: b},
+	}
+	deps := map[string][]string{
+		"b": {"a"},
+		"c": {"b"},
+	}
+	opts := &buildOpts{jobs: 2, keepGoing: true}
+	failed, _ := testBuild(t, opts, rules, deps)
+	if want := []string{"a"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("got failed %q, want %q", failed, want)
+	}
+	built := b.sorted(b.built)
+	if want := []string{"d"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got built %q, want %q", built, want)
+	}
+}
+
+func TestBuildKeepGoing(t *testing.T) {
+	b := new(fakeBuild)
+	rules := []*fakeRule{
+		{name: "a", b: b, run: failRule},
+		{name: "b", b: b, run: failRule},
+		{name: "c", b: b},
+		{name: "d", b: b, run: sleepRule},
+		{name: "e", b: b, run: failRule},
+	}
+	deps := map[string][]string{"c": {"a", "b"}}
+	opts := &buildOpts{jobs: 1, keepGoing: true}
+	failed, _ := testBuild(t, opts, rules, deps)
+	if want := []string{"a", "b", "e"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("got failed %q, want %q", failed, want)
+	}
+	built := b.sorted(b.built)
+	if want := []string{"d"}; !reflect.DeepEqual(built, want) {
+		t.Errorf("got built %q, want %q", built, want)
+	}
+}
+
+func TestBuildAbort(t *testing.T) {
+	b := new(fakeBuild)
+	started := make(chan struct{})
+	wait := func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	fail := func(ctx context.Context) error {
+		<-started
+		return failRule(ctx)
+	}
+	rules := []*fakeRule{
+		{name: "a", b: b, run: fail},
+		{name: "b", b: b, run: wait},
+		{name: "c", b: b},
+	}
+	deps := map[string][]string{"c": {"b"}}
+	opts := &buildOpts{jobs: 2}
+	failed, _ := testBuild(t, opts, rules, deps)
+	if want := []string{"a"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("got failed %q, want %q", failed, want)
+	}
+	canceled := b.sorted(b.canceled)
+	if want := []string{"b"}; !reflect.DeepEqual(canceled, want) {
+		t.Errorf("got canceled %q, want %q", canceled, want)
+	}
+	if len(b.built) != 0 {
+		t.Errorf("got built %q, want none", b.built)
+	}
+}
+
+func TestBuildJobs(t *testing.T) {
+	for _, jobs := range []int{1, 3} {
+		b := new(fakeBuild)
+		var rules []*fakeRule
+		var names []string
+		for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+			rules = append(rules, &fakeRule{name: name, b: b, run: sleepRule})
+			names = append(names, name)
+		}
+		opts := &buildOpts{jobs: jobs}
+		if failed, _ := testBuild(t, opts, rules, nil); len(failed) != 0 {
+			t.Errorf("jobs %d: got failed %q", jobs, failed)
+		}
+		if got := b.sorted(b.built); !reflect.DeepEqual(got, names) {
+			t.Errorf("jobs %d: got built %q, want %q", jobs, got, names)
+		}
+		if b.maxRunning > jobs {
+			t.Errorf(
+				"jobs %d: got %d rules running at once",
+				jobs, b.maxRunning,
+			)
+		}
+	}
+}
+
+func TestBuildRecords(t *testing.T) {
+	b := new(fakeBuild)
+	rules := []*fakeRule{
+		{name: "a", b: b, run: failRule, digest: "a"},
+		{name: "b", b: b, digest: "b"},
+		{name: "c", b: b},
+	}
+	opts := &buildOpts{jobs: 1, keepGoing: true}
+	_, cache := testBuild(t, opts, rules, nil)
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"a", false}, // Failed.
+		{"b", true},
+		{"c", false}, // Always rebuilds.
+	} {
+		recs, err := cache.getRecords(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := recs != nil; got != test.want {
+			t.Errorf(
+				"%q has records: got %t, want %t",
+				test.name, got, test.want,
+			)
+		}
+	}
+}
@@ -17,6 +17,7 @@ package caco3
 
 import (
 	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/jsonutil"
 	"shanhu.io/virgo/dock"
 )
 
@@ -45,6 +46,13 @@ func newBuilt(env *env, meta *buildRuleMeta) (*built, error) {
 		}
 		b.Outs = append(b.Outs, stat)
 	}
+	for _, out := range meta.dirOuts {
+		var list []*fileStat
+		if err := jsonutil.ReadFile(env.out(out), &list); err != nil {
+			return nil, errcode.Annotatef(err, "read file set: %s", out)
+		}
+		b.Outs = append(b.Outs, list...)
+	}
 	return b, nil
 }
 
@@ -16,6 +16,8 @@
 package caco3
 
 import (
+	"context"
+
 	"shanhu.io/misc/errcode"
 )
 
@@ -39,7 +41,9 @@ func newBundle(env *env, p string, r *Bundle) *bundle {
 	}
 }
 
-func (b *bundle) build(env *env, opts *buildOpts) error {
+func (b *bundle) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
 	return nil
 }
 
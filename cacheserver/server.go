@@ -0,0 +1,169 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package cacheserver is a reference server of the caco3 remote build
+// cache. It saves everything in a directory on the local file system.
+//
+// The protocol has two namespaces, both keyed by hex encoded sha256 hashes:
+//
+//	/ac/<digest>  action results: JSON objects that list the outputs of
+//	              a build action, keyed by the digest of the action.
+//	/cas/<sum>    content-addressed blobs of output files, keyed by the
+//	              sha256 of the content.
+//
+// GET reads an entry, and responds 404 when the entry is not found. PUT
+// writes an entry. Blobs are verified against their keys before saved.
+package cacheserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nsAction = "ac"
+	nsBlob   = "cas"
+)
+
+// maxActionSize is the max size of an action result.
+const maxActionSize = 1 << 20
+
+// Server serves a remote build cache.
+type Server struct {
+	dir string
+}
+
+// New creates a new cache server that saves entries under dir.
+func New(dir string) *Server {
+	return &Server{dir: dir}
+}
+
+func validKey(k string) bool {
+	if len(k) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(k)
+	return err == nil
+}
+
+func (s *Server) file(ns, k string) string {
+	return filepath.Join(s.dir, ns, k[:2], k)
+}
+
+func (s *Server) get(w http.ResponseWriter, req *http.Request, f string) {
+	if _, err := os.Stat(f); err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, req)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "stat failed", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, req, f)
+}
+
+// save saves the content of r into f. When sum is not empty, the content
+// must match the sha256 hash.
+func save(f string, r io.Reader, sum string) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f), "tmp-*")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if sum != "" && hex.EncodeToString(h.Sum(nil)) != sum {
+		return http.StatusBadRequest, errBadSum
+	}
+	if err := tmp.Close(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := os.Rename(tmp.Name(), f); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+var (
+	errBadSum    = errors.New("content does not match the key")
+	errBadAction = errors.New("invalid action result")
+)
+
+func (s *Server) put(
+	w http.ResponseWriter, req *http.Request, ns, k string,
+) {
+	var r io.Reader = req.Body
+	sum := ""
+	if ns == nsBlob {
+		sum = k
+	} else {
+		bs, err := io.ReadAll(io.LimitReader(req.Body, maxActionSize+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(bs) > maxActionSize || !json.Valid(bs) {
+			http.Error(w, errBadAction.Error(), http.StatusBadRequest)
+			return
+		}
+		r = bytes.NewReader(bs)
+	}
+
+	code, err := save(s.file(ns, k), r, sum)
+	if err != nil {
+		if code == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(code)
+}
+
+// ServeHTTP serves a cache request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ns, k, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if !ok || (ns != nsAction && ns != nsBlob) || !validKey(k) {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		s.get(w, req, s.file(ns, k))
+	case http.MethodPut:
+		s.put(w, req, ns, k)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -16,8 +16,12 @@
 package caco3bin
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 
 	"shanhu.io/caco3"
 	"shanhu.io/misc/errcode"
@@ -28,31 +32,55 @@ func cmdBuild(args []string) error {
 	flags := cmdFlags.New()
 	config := new(caco3.Config)
 	declareBuildFlags(flags, config)
+	plan := flags.Bool("n", false, "only print the rules that would execute")
+	events := flags.String(
+		"events", "", "write build events into this file as JSON lines",
+	)
 	args = flags.ParseArgs(args)
 
-	wd, err := os.Getwd()
+	b, wd, err := newBuilder(config)
 	if err != nil {
-		return errcode.Annotate(err, "get work dir")
+		return err
 	}
-	if config.Root != "" {
-		root, err := filepath.Abs(config.Root)
-		if err != nil {
-			return errcode.Annotate(err, "get abs root dir")
+
+	if *plan {
+		steps, errs := b.Plan(args)
+		if errs != nil {
+			lexing.FprintErrs(os.Stderr, errs, wd)
+			return errcode.InvalidArgf("plan got %d errors", len(errs))
+		}
+		for _, step := range steps {
+			action := "BUILD"
+			if step.Restore {
+				action = "RESTORE"
+			}
+			fmt.Printf("%s %s (%s)\n", action, step.Rule, step.Reason)
 		}
-		config.Root = root
+		return nil
 	}
 
-	b, err := caco3.NewBuilder(wd, config)
-	if err != nil {
-		return errcode.Annotate(err, "new builder")
-	}
+	if *events != "" {
+		f, err := os.Create(*events)
+		if err != nil {
+			return errcode.Annotate(err, "create events file")
+		}
+		defer f.Close()
 
-	if _, errs := b.ReadWorkspace(); errs != nil {
-		lexing.FprintErrs(os.Stderr, errs, wd)
-		return errcode.InvalidArgf("read workspace got %d errors", len(errs))
+		w := caco3.NewJSONEventWriter(f)
+		b.AddObserver(w)
+		defer func() {
+			if err := w.Err(); err != nil {
+				log.Printf("write events: %s", err)
+			}
+		}()
 	}
 
-	if errs := b.Build(args); errs != nil {
+	ctx, stop := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+	defer stop()
+
+	if errs := b.Build(ctx, args); errs != nil {
 		lexing.FprintErrs(os.Stderr, errs, wd)
 		return errcode.InvalidArgf("build got %d errors", len(errs))
 	}
@@ -0,0 +1,54 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"os"
+	"path/filepath"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+// newBuilder creates a builder for the current working directory, and
+// reads in the workspace. It also returns the working directory.
+func newBuilder(config *caco3.Config) (*caco3.Builder, string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, "", errcode.Annotate(err, "get work dir")
+	}
+	if config.Root != "" {
+		root, err := filepath.Abs(config.Root)
+		if err != nil {
+			return nil, "", errcode.Annotate(err, "get abs root dir")
+		}
+		config.Root = root
+	}
+
+	b, err := caco3.NewBuilder(wd, config)
+	if err != nil {
+		return nil, "", errcode.Annotate(err, "new builder")
+	}
+
+	if _, errs := b.ReadWorkspace(); errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return nil, "", errcode.InvalidArgf(
+			"read workspace got %d errors", len(errs),
+		)
+	}
+	return b, wd, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"fmt"
+	"os"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/subcmd"
+	"shanhu.io/text/lexing"
+)
+
+func cmdCacheGC(args []string) error {
+	flags := cmdFlags.New()
+	config := new(caco3.Config)
+	flags.StringVar(&config.Root, "root", "", "root directory")
+	flags.StringVar(
+		&config.LocalCASDir, "local_cas_dir", "",
+		"directory of the local content-addressed store",
+	)
+	dryRun := flags.Bool("dry_run", false, "only list the garbage")
+	flags.ParseArgs(args)
+
+	b, wd, err := newBuilder(config)
+	if err != nil {
+		return err
+	}
+
+	opts := &caco3.GCOptions{DryRun: *dryRun}
+	res, errs := b.GC(opts)
+	if errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return errcode.InvalidArgf("gc got %d errors", len(errs))
+	}
+
+	for _, k := range res.CacheEntries {
+		fmt.Println("cache", k)
+	}
+	for _, out := range res.Outputs {
+		fmt.Println("out", b.Out(out))
+	}
+	for _, tag := range res.Dockers {
+		fmt.Println("docker", tag)
+	}
+	for _, blob := range res.Blobs {
+		fmt.Println("blob", blob)
+	}
+	for _, name := range res.Records {
+		fmt.Println("record", name)
+	}
+	for _, k := range res.FileHashes {
+		fmt.Println("hash", k)
+	}
+	return nil
+}
+
+func cacheCmd() *subcmd.List {
+	c := subcmd.New()
+	c.Add("gc", "garbage collect the build cache", cmdCacheGC)
+	return c
+}
+
+func cmdCache(args []string) error {
+	args = append([]string{"caco3 cache"}, args...)
+	if ret := cacheCmd().Run(args); ret != 0 {
+		return errcode.InvalidArgf("cache command failed")
+	}
+	return nil
+}
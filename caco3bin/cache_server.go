@@ -0,0 +1,38 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"log"
+	"net/http"
+
+	"shanhu.io/caco3/cacheserver"
+	"shanhu.io/misc/errcode"
+)
+
+func cmdCacheServer(args []string) error {
+	flags := cmdFlags.New()
+	addr := flags.String("addr", "localhost:3363", "address to listen on")
+	dir := flags.String("dir", "caco3-cache", "directory to save the cache")
+	flags.ParseArgs(args)
+
+	if *dir == "" {
+		return errcode.InvalidArgf("cache directory not specified")
+	}
+
+	log.Printf("serving cache in %q on %s", *dir, *addr)
+	return http.ListenAndServe(*addr, cacheserver.New(*dir))
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"fmt"
+	"os"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+func cmdClean(args []string) error {
+	flags := cmdFlags.New()
+	config := new(caco3.Config)
+	flags.StringVar(&config.Root, "root", "", "root directory")
+	dryRun := flags.Bool("dry_run", false, "only list the files to remove")
+	args = flags.ParseArgs(args)
+
+	b, wd, err := newBuilder(config)
+	if err != nil {
+		return err
+	}
+
+	opts := &caco3.CleanOptions{DryRun: *dryRun}
+	names, errs := b.Clean(args, opts)
+	if errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return errcode.InvalidArgf("clean got %d errors", len(errs))
+	}
+	for _, name := range names {
+		fmt.Println(b.Out(name))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"shanhu.io/caco3"
+)
+
+type dotOptions struct {
+	// Draw a file set, its output and the source files that only it
+	// uses as a single node.
+	collapseFileSets bool
+}
+
+type dotStyle struct {
+	shape string
+	color string
+}
+
+func (s *dotStyle) attrs() string {
+	return fmt.Sprintf(
+		"shape=%s, style=filled, fillcolor=%s", s.shape, s.color,
+	)
+}
+
+func dotNodeStyle(n *caco3.GraphNode) *dotStyle {
+	switch n.Kind() {
+	case caco3.NodeFileSet:
+		return &dotStyle{shape: "folder", color: "lightyellow"}
+	case caco3.NodeBundle:
+		return &dotStyle{shape: "box", color: "white"}
+	case caco3.NodeRule:
+		return &dotStyle{shape: "box", color: "lightblue"}
+	case caco3.NodeSrc:
+		return &dotStyle{shape: "note", color: "whitesmoke"}
+	case caco3.NodeDockerSum:
+		return &dotStyle{shape: "box3d", color: "orange"}
+	case caco3.NodeFileSetOut:
+		return &dotStyle{shape: "tab", color: "khaki"}
+	case caco3.NodeOut:
+		return &dotStyle{shape: "note", color: "palegreen"}
+	}
+	return &dotStyle{shape: "ellipse", color: "white"}
+}
+
+// collapseFileSets maps the nodes merged into file sets to the file sets.
+// It returns the map, and the number of files merged into each file set.
+func collapseFileSets(nodes []*caco3.GraphNode) (
+	map[string]string, map[string]int,
+) {
+	users := make(map[string]int)
+	for _, n := range nodes {
+		for _, dep := range n.Deps {
+			users[dep]++
+		}
+	}
+	srcs := make(map[string]bool)
+	for _, n := range nodes {
+		if n.Kind() == caco3.NodeSrc {
+			srcs[n.Name] = true
+		}
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for _, n := range nodes {
+		if n.Kind() != caco3.NodeFileSet {
+			continue
+		}
+		for _, out := range n.Outs {
+			owners[out] = n.Name
+		}
+		for _, dep := range n.Deps {
+			if srcs[dep] && users[dep] == 1 {
+				owners[dep] = n.Name
+				counts[n.Name]++
+			}
+		}
+	}
+	return owners, counts
+}
+
+// writeDot writes the nodes as a Graphviz dot graph. Only the edges
+// between the given nodes are drawn.
+func writeDot(
+	w io.Writer, nodes []*caco3.GraphNode, opts *dotOptions,
+) error {
+	bw := bufio.NewWriter(w)
+
+	set := make(map[string]bool)
+	for _, n := range nodes {
+		set[n.Name] = true
+	}
+	var owners map[string]string
+	var counts map[string]int
+	if opts.collapseFileSets {
+		owners, counts = collapseFileSets(nodes)
+	}
+	target := func(name string) string {
+		if owner, ok := owners[name]; ok {
+			return owner
+		}
+		return name
+	}
+
+	fmt.Fprintln(bw, "digraph caco3 {")
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	for _, n := range nodes {
+		if _, ok := owners[n.Name]; ok {
+			continue
+		}
+		label := n.Name
+		if c, ok := counts[n.Name]; ok {
+			files := "files"
+			if c == 1 {
+				files = "file"
+			}
+			label = fmt.Sprintf("%s\n(%d %s)", n.Name, c, files)
+		}
+		fmt.Fprintf(
+			bw, "  %s [label=%s, %s];\n",
+			strconv.Quote(n.Name), strconv.Quote(label),
+			dotNodeStyle(n).attrs(),
+		)
+	}
+	for _, n := range nodes {
+		if _, ok := owners[n.Name]; ok {
+			continue
+		}
+		deps := make(map[string]bool)
+		for _, dep := range n.Deps {
+			if !set[dep] {
+				continue
+			}
+			if t := target(dep); t != n.Name {
+				deps[t] = true
+			}
+		}
+		var list []string
+		for dep := range deps {
+			list = append(list, dep)
+		}
+		sort.Strings(list)
+		for _, dep := range list {
+			fmt.Fprintf(
+				bw, "  %s -> %s;\n",
+				strconv.Quote(n.Name), strconv.Quote(dep),
+			)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+
+	return bw.Flush()
+}
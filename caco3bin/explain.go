@@ -0,0 +1,61 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+func printChange(w io.Writer, c *caco3.Change, indent int) {
+	pad := strings.Repeat("  ", indent)
+	fmt.Fprintf(w, "%s%s:\n", pad, c.Node)
+	for _, r := range c.Reasons {
+		fmt.Fprintf(w, "%s  %s\n", pad, r)
+	}
+	for _, dep := range c.Deps {
+		printChange(w, dep, indent+1)
+	}
+}
+
+func cmdExplain(args []string) error {
+	flags := cmdFlags.New()
+	config := new(caco3.Config)
+	declareBuildFlags(flags, config)
+	args = flags.ParseArgs(args)
+	if len(args) != 1 {
+		return errcode.InvalidArgf("need exactly one target")
+	}
+
+	b, wd, err := newBuilder(config)
+	if err != nil {
+		return err
+	}
+
+	c, errs := b.Explain(args[0])
+	if errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return errcode.InvalidArgf("explain got %d errors", len(errs))
+	}
+	printChange(os.Stdout, c, 0)
+	return nil
+}
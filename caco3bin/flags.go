@@ -25,6 +25,36 @@ var cmdFlags = flagutil.NewFactory("caco3")
 func declareBuildFlags(flags *flagutil.FlagSet, c *caco3.Config) {
 	flags.StringVar(&c.Root, "root", "", "root directory")
 	flags.BoolVar(&c.AlwaysRebuild, "rebuild", false, "always rebuild")
+	flags.IntVar(&c.Jobs, "jobs", 1, "number of rules to build concurrently")
+	flags.BoolVar(
+		&c.KeepGoing, "keep_going", false,
+		"keep building rules that do not depend on a failed rule",
+	)
+	flags.BoolVar(
+		&c.ContentHash, "content_hash", false,
+		"detect file changes by content hashes rather than timestamps",
+	)
+	flags.BoolVar(
+		&c.LocalCAS, "local_cas", false,
+		"keep outputs in a local content-addressed store and restore "+
+			"from it",
+	)
+	flags.StringVar(
+		&c.LocalCASDir, "local_cas_dir", "",
+		"directory of the local content-addressed store",
+	)
+	flags.StringVar(
+		&c.RemoteCache, "remote_cache", "",
+		"URL of the remote build cache server",
+	)
+	flags.BoolVar(
+		&c.RemoteCacheReadOnly, "remote_cache_read_only", false,
+		"do not upload build results to the remote cache",
+	)
+	flags.StringVar(
+		&c.Trace, "trace", "",
+		"write a Chrome trace of the build into this file",
+	)
 	flags.BoolVar(
 		&c.UseDockerBuildCache, "docker_build_cache", true,
 		"use docker build cache or not",
@@ -0,0 +1,62 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"encoding/json"
+	"os"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+func cmdGraph(args []string) error {
+	flags := cmdFlags.New()
+	root := flags.String("root", "", "root directory")
+	output := flags.String("output", "dot", "output format: dot or json")
+	collapse := flags.Bool(
+		"collapse_file_sets", false,
+		"draw each file set and its files as a single node",
+	)
+	args = flags.ParseArgs(args)
+	if len(args) == 0 {
+		return errcode.InvalidArgf("missing targets")
+	}
+
+	b, wd, err := newBuilder(&caco3.Config{Root: *root})
+	if err != nil {
+		return err
+	}
+
+	nodes, errs := b.Graph(args)
+	if errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return errcode.InvalidArgf("graph got %d errors", len(errs))
+	}
+
+	switch *output {
+	case "dot":
+		return writeDot(os.Stdout, nodes, &dotOptions{
+			collapseFileSets: *collapse,
+		})
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	}
+	return errcode.InvalidArgf("unknown output format %q", *output)
+}
@@ -23,6 +23,12 @@ func cmd() *subcmd.List {
 	c := subcmd.New()
 	c.Add("build", "build rules", cmdBuild)
 	c.Add("sync", "sync source repos", cmdSync)
+	c.Add("explain", "explain why a target is rebuilt", cmdExplain)
+	c.Add("query", "query the build graph", cmdQuery)
+	c.Add("graph", "print the build graph of targets", cmdGraph)
+	c.Add("clean", "remove build outputs", cmdClean)
+	c.Add("cache", "manage the build cache", cmdCache)
+	c.Add("cache_server", "serve a remote build cache", cmdCacheServer)
 	return c
 }
 
@@ -0,0 +1,66 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3bin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"shanhu.io/caco3"
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+func cmdQuery(args []string) error {
+	flags := cmdFlags.New()
+	root := flags.String("root", "", "root directory")
+	output := flags.String(
+		"output", "names", "output format: names, json or dot",
+	)
+	args = flags.ParseArgs(args)
+	if len(args) == 0 {
+		return errcode.InvalidArgf("missing query")
+	}
+
+	b, wd, err := newBuilder(&caco3.Config{Root: *root})
+	if err != nil {
+		return err
+	}
+
+	nodes, errs := b.Query(strings.Join(args, " "))
+	if errs != nil {
+		lexing.FprintErrs(os.Stderr, errs, wd)
+		return errcode.InvalidArgf("query got %d errors", len(errs))
+	}
+
+	switch *output {
+	case "names":
+		for _, n := range nodes {
+			fmt.Println(n.Name)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	case "dot":
+		return writeDot(os.Stdout, nodes, &dotOptions{})
+	default:
+		return errcode.InvalidArgf("unknown output format %q", *output)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/osutil"
+	"shanhu.io/text/lexing"
+)
+
+// CleanOptions contains options for cleaning build outputs.
+type CleanOptions struct {
+	DryRun bool // Only list the files, do not remove anything.
+}
+
+func (b *Builder) cleanAll(opts *CleanOptions) ([]string, error) {
+	entries, err := os.ReadDir(b.env.outDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errcode.Annotate(err, "read output dir")
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		names = append(names, name)
+		if opts.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(b.env.out(name)); err != nil {
+			return nil, errcode.Annotatef(err, "remove %q", name)
+		}
+	}
+	return names, nil
+}
+
+// Clean removes the outputs of the given rules. When rules is empty, it
+// removes everything in the output directory. It returns the names of the
+// removed files, relative to the output directory.
+func (b *Builder) Clean(rules []string, opts *CleanOptions) (
+	[]string, []*lexing.Error,
+) {
+	if len(rules) == 0 {
+		names, err := b.cleanAll(opts)
+		if err != nil {
+			return nil, lexing.SingleErr(err)
+		}
+		return names, nil
+	}
+
+	nodes, _, errs := loadNodes(b.env, b.absRules(rules))
+	if errs != nil {
+		return nil, errs
+	}
+	return b.cleanNodes(nodes, opts)
+}
+
+// cleanNodes removes the outputs of the given rule and output nodes.
+func (b *Builder) cleanNodes(nodes []*buildNode, opts *CleanOptions) (
+	[]string, []*lexing.Error,
+) {
+	errList := lexing.NewErrorList()
+	outs := make(map[string]bool)
+	dirs := make(map[string]bool) // Removed with all the files in them.
+	for _, n := range nodes {
+		switch n.typ {
+		case nodeRule:
+			if n.ruleMeta != nil {
+				for _, out := range n.ruleMeta.outs {
+					outs[out] = true
+				}
+				for _, out := range n.ruleMeta.dirOuts {
+					dirs[strings.TrimSuffix(out, fileSetExt)] = true
+				}
+			}
+			if n.ruleType == ruleExec {
+				// Scratch dir that is kept after a failed run.
+				dirs[path.Join(execDirName, n.name)] = true
+			}
+		case nodeOut:
+			outs[n.name] = true
+		default:
+			errList.Errorf(n.pos, "%q has no outputs", n.name)
+		}
+	}
+	if errs := errList.Errs(); errs != nil {
+		return nil, errs
+	}
+
+	var names []string
+	for dir := range dirs {
+		f := b.env.out(dir)
+		exist, err := osutil.Exist(f)
+		if err != nil {
+			return nil, lexing.SingleErr(err)
+		}
+		if !exist {
+			continue
+		}
+		names = append(names, dir)
+		if opts.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(f); err != nil {
+			err = errcode.Annotatef(err, "remove %q", dir)
+			return nil, lexing.SingleErr(err)
+		}
+	}
+	for out := range outs {
+		f := b.env.out(out)
+		exist, err := osutil.Exist(f)
+		if err != nil {
+			return nil, lexing.SingleErr(err)
+		}
+		if !exist {
+			continue
+		}
+		names = append(names, out)
+		if opts.DryRun {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			err = errcode.Annotatef(err, "remove %q", out)
+			return nil, lexing.SingleErr(err)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// relOut returns the slash path of f relative to the output directory.
+func (b *Builder) relOut(f string) (string, error) {
+	rel, err := filepath.Rel(b.env.outDir, f)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"shanhu.io/misc/osutil"
+)
+
+func TestCleanNodes(t *testing.T) {
+	env := &env{outDir: t.TempDir()}
+	for _, f := range []string{
+		"p/out.txt",
+		"p/dist.fileset",
+		"p/dist/a.txt",
+		"p/dist/sub/b.txt",
+		"p/distx/c.txt",
+		"_exec/p/gen/x.txt",
+		"_exec/p/other/y.txt",
+	} {
+		p := env.out(f)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := &buildNode{
+		name:     "p/run",
+		typ:      nodeRule,
+		ruleType: ruleDockerRun,
+		ruleMeta: &buildRuleMeta{
+			name:    "p/run",
+			outs:    []string{"p/out.txt", "p/dist.fileset"},
+			dirOuts: []string{"p/dist.fileset"},
+		},
+	}
+	gen := &buildNode{
+		name:     "p/gen",
+		typ:      nodeRule,
+		ruleType: ruleExec,
+		ruleMeta: &buildRuleMeta{name: "p/gen"},
+	}
+	nodes := []*buildNode{run, gen}
+	b := &Builder{env: env}
+
+	want := []string{
+		"_exec/p/gen",
+		"p/dist",
+		"p/dist.fileset",
+		"p/out.txt",
+	}
+	names, errs := b.cleanNodes(nodes, &CleanOptions{DryRun: true})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("dry run got %q, want %q", names, want)
+	}
+	if _, err := os.Stat(env.out("p/dist/a.txt")); err != nil {
+		t.Fatalf("dry run removed files: %s", err)
+	}
+
+	names, errs = b.cleanNodes(nodes, &CleanOptions{})
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+	for _, f := range want {
+		if exist, err := osutil.Exist(env.out(f)); err != nil {
+			t.Fatal(err)
+		} else if exist {
+			t.Errorf("%q not removed", f)
+		}
+	}
+	for _, f := range []string{"p/distx/c.txt", "_exec/p/other/y.txt"} {
+		if _, err := os.Stat(env.out(f)); err != nil {
+			t.Errorf("%q removed: %s", f, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"shanhu.io/misc/errcode"
+)
+
+// digester computes the records of nodes without building them.
+type digester struct {
+	env   *env
+	nodes map[string]*buildNode
+
+	done map[string]bool
+	recs map[string]*nodeRecord
+}
+
+func newDigester(env *env, nodes map[string]*buildNode) *digester {
+	return &digester{
+		env:   env,
+		nodes: nodes,
+		done:  make(map[string]bool),
+		recs:  make(map[string]*nodeRecord),
+	}
+}
+
+// record returns the record of node n. It returns nil if the node always
+// needs re-execution.
+func (d *digester) record(n *buildNode) (*nodeRecord, error) {
+	if d.done[n.name] {
+		return d.recs[n.name], nil
+	}
+
+	deps := make(map[string]string)
+	for _, dep := range n.deps {
+		depNode := d.nodes[dep]
+		if depNode == nil {
+			return nil, errcode.InvalidArgf(
+				"dep %q for %q not found", dep, n.name,
+			)
+		}
+		rec, err := d.record(depNode)
+		if err != nil {
+			return nil, err
+		}
+		if rec == nil {
+			deps = nil
+		} else if deps != nil {
+			deps[dep] = rec.Digest
+		}
+	}
+
+	var rec *nodeRecord
+	if deps != nil {
+		r, err := newNodeRecord(d.env, n, deps)
+		if err != nil {
+			return nil, errcode.Annotatef(err, "digest %q", n.name)
+		}
+		rec = r
+	}
+	d.done[n.name] = true
+	d.recs[n.name] = rec
+	return rec, nil
+}
@@ -21,6 +21,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"reflect"
 
 	"shanhu.io/misc/errcode"
 )
@@ -38,6 +39,9 @@ type buildAction struct {
 	DockerOut bool     `json:",omitempty"`
 
 	OutputOf string `json:",omitempty"` // Get the output from a rule.
+
+	// Values of the variables that the rule references.
+	Vars map[string]string `json:",omitempty"`
 }
 
 func makeDigest(t, name string, v interface{}) (string, error) {
@@ -52,3 +56,15 @@ func makeDigest(t, name string, v interface{}) (string, error) {
 	sum := sha256.Sum256(buf.Bytes())
 	return "sha256:" + hex.EncodeToString(sum[:]), nil
 }
+
+// clearNonOutputFields clears the fields of rule definition r, a pointer
+// to a copy of a rule, that do not change the outputs of the rule, so
+// that they are left out of the rule digest.
+func clearNonOutputFields(r interface{}) {
+	v := reflect.ValueOf(r).Elem()
+	for _, name := range []string{"Timeout", "Visibility"} {
+		if f := v.FieldByName(name); f.IsValid() {
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClearNonOutputFields(t *testing.T) {
+	rule := &Exec{
+		Name:       "gen",
+		Timeout:    "5m",
+		Visibility: []string{"private"},
+	}
+	clearNonOutputFields(rule)
+	if want := (&Exec{Name: "gen"}); !reflect.DeepEqual(rule, want) {
+		t.Errorf("got %+v, want %+v", rule, want)
+	}
+
+	// Rules without a timeout only get the visibility cleared.
+	set := &FileSet{Name: "srcs", Visibility: []string{"public"}}
+	clearNonOutputFields(set)
+	if want := (&FileSet{Name: "srcs"}); !reflect.DeepEqual(set, want) {
+		t.Errorf("got %+v, want %+v", set, want)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"shanhu.io/misc/errcode"
+)
+
+// dockerSock is the default path of the socket of the docker daemon.
+const dockerSock = "/var/run/docker.sock"
+
+// dockerAPI is a small client of the docker engine API, for the calls that
+// package dock does not have, like removing images, copying tarballs with
+// symlinks into image builds and containers, and setting resource limits
+// on containers.
+type dockerAPI struct {
+	client *http.Client
+}
+
+func newDockerAPI(sock string) *dockerAPI {
+	if sock == "" {
+		sock = dockerSock
+	}
+	tr := &http.Transport{
+		DialContext: func(
+			ctx context.Context, _, _ string,
+		) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}
+	return &dockerAPI{client: &http.Client{Transport: tr}}
+}
+
+func (a *dockerAPI) do(
+	ctx context.Context, method, p string, q url.Values,
+	contentType string, body io.Reader,
+) (*http.Response, error) {
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     "docker",
+		Path:     p,
+		RawQuery: q.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var msg struct{ Message string }
+	bs, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(bs, &msg); err != nil || msg.Message == "" {
+		msg.Message = string(bytes.TrimSpace(bs))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errcode.NotFoundf("docker: %s", msg.Message)
+	}
+	return nil, errcode.Internalf(
+		"docker: %s %s: %s", method, p, msg.Message,
+	)
+}
+
+func (a *dockerAPI) call(
+	ctx context.Context, method, p string, q url.Values, req, resp interface{},
+) error {
+	var body io.Reader
+	var contentType string
+	if req != nil {
+		bs, err := json.Marshal(req)
+		if err != nil {
+			return errcode.Annotate(err, "encode request")
+		}
+		body = bytes.NewReader(bs)
+		contentType = "application/json"
+	}
+	r, err := a.do(ctx, method, p, q, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if resp == nil {
+		_, err := io.Copy(io.Discard, r.Body)
+		return err
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// buildImage builds image tag from the build context written by files,
+// and writes the build output into w.
+func (a *dockerAPI) buildImage(
+	ctx context.Context, tag string, files io.WriterTo,
+	args map[string]string, w io.Writer,
+) error {
+	q := url.Values{
+		"t":  []string{tag},
+		"rm": []string{"1"},
+	}
+	if len(args) > 0 {
+		bs, err := json.Marshal(args)
+		if err != nil {
+			return errcode.Annotate(err, "encode build args")
+		}
+		q.Set("buildargs", string(bs))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := files.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // Unblocks the writing when returning early.
+
+	resp, err := a.do(ctx, "POST", "/build", q, "application/x-tar", pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The response is a stream of JSON messages of the build progress.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Stream string
+			Error  string
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errcode.Annotate(err, "read build progress")
+		}
+		if msg.Error != "" {
+			return errcode.Internalf("docker build: %s", msg.Error)
+		}
+		if _, err := io.WriteString(w, msg.Stream); err != nil {
+			return err
+		}
+	}
+}
+
+// removeImage removes image tag. The image is deleted when no other tags
+// reference it.
+func (a *dockerAPI) removeImage(ctx context.Context, tag string) error {
+	return a.call(ctx, "DELETE", "/images/"+tag, nil, nil, nil)
+}
+
+// contMount is a bind mount of a host directory into the container.
+type contMount struct {
+	host     string
+	cont     string
+	readOnly bool
+}
+
+// contConfig is the config of creating a container.
+type contConfig struct {
+	cmd     []string
+	workDir string
+	env     map[string]string
+	mounts  []*contMount
+
+	network        string // Network mode, like "none" or "host".
+	memory         int64  // Memory limit in bytes.
+	nanoCPUs       int64  // CPU limit in 1e-9 CPUs.
+	tmpfs          map[string]string
+	readOnlyRootfs bool
+	capDrop        []string
+}
+
+type dockerMount struct {
+	Type     string
+	Source   string
+	Target   string
+	ReadOnly bool `json:",omitempty"`
+}
+
+type dockerHostConfig struct {
+	Mounts         []*dockerMount    `json:",omitempty"`
+	NetworkMode    string            `json:",omitempty"`
+	Memory         int64             `json:",omitempty"`
+	NanoCpus       int64             `json:",omitempty"`
+	Tmpfs          map[string]string `json:",omitempty"`
+	ReadonlyRootfs bool              `json:",omitempty"`
+	CapDrop        []string          `json:",omitempty"`
+}
+
+type dockerContCreate struct {
+	Image      string
+	Cmd        []string `json:",omitempty"`
+	Env        []string `json:",omitempty"`
+	WorkingDir string   `json:",omitempty"`
+	HostConfig *dockerHostConfig
+}
+
+// dockerCont is a container created with the docker API.
+type dockerCont struct {
+	api *dockerAPI
+	id  string
+}
+
+func (a *dockerAPI) createCont(
+	ctx context.Context, image string, config *contConfig,
+) (*dockerCont, error) {
+	var envs []string
+	for k, v := range config.env {
+		envs = append(envs, k+"="+v)
+	}
+	sort.Strings(envs)
+
+	host := &dockerHostConfig{
+		NetworkMode:    config.network,
+		Memory:         config.memory,
+		NanoCpus:       config.nanoCPUs,
+		Tmpfs:          config.tmpfs,
+		ReadonlyRootfs: config.readOnlyRootfs,
+		CapDrop:        config.capDrop,
+	}
+	for _, m := range config.mounts {
+		host.Mounts = append(host.Mounts, &dockerMount{
+			Type:     "bind",
+			Source:   m.host,
+			Target:   m.cont,
+			ReadOnly: m.readOnly,
+		})
+	}
+	req := &dockerContCreate{
+		Image:      image,
+		Cmd:        config.cmd,
+		Env:        envs,
+		WorkingDir: config.workDir,
+		HostConfig: host,
+	}
+	var resp struct{ Id string }
+	if err := a.call(
+		ctx, "POST", "/containers/create", nil, req, &resp,
+	); err != nil {
+		return nil, err
+	}
+	return &dockerCont{api: a, id: resp.Id}, nil
+}
+
+func (c *dockerCont) path(p string) string {
+	return "/containers/" + c.id + p
+}
+
+// copyIn extracts the tarball written by ts into dir in the container.
+func (c *dockerCont) copyIn(
+	ctx context.Context, ts io.WriterTo, dir string,
+) error {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := ts.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // Unblocks the writing when returning early.
+
+	q := url.Values{"path": []string{dir}}
+	resp, err := c.api.do(
+		ctx, "PUT", c.path("/archive"), q, "application/x-tar", pr,
+	)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *dockerCont) start(ctx context.Context) error {
+	return c.api.call(ctx, "POST", c.path("/start"), nil, nil, nil)
+}
+
+// followLogs copies the stdout and stderr of the container into w until
+// the container exits.
+func (c *dockerCont) followLogs(ctx context.Context, w io.Writer) error {
+	q := url.Values{
+		"follow": []string{"1"},
+		"stdout": []string{"1"},
+		"stderr": []string{"1"},
+	}
+	resp, err := c.api.do(ctx, "GET", c.path("/logs"), q, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Without a TTY, the logs are frames of an 8-byte header followed by
+	// the payload, where the last 4 bytes of the header is the size of
+	// the payload.
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(resp.Body, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, resp.Body, n); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for the container to exit, and returns its exit code.
+func (c *dockerCont) wait(ctx context.Context) (int, error) {
+	q := url.Values{"condition": []string{"not-running"}}
+	var resp struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}
+	if err := c.api.call(
+		ctx, "POST", c.path("/wait"), q, nil, &resp,
+	); err != nil {
+		return 0, err
+	}
+	if resp.Error != nil && resp.Error.Message != "" {
+		return 0, errcode.Internalf("wait: %s", resp.Error.Message)
+	}
+	return resp.StatusCode, nil
+}
+
+// copyOut writes file or directory from in the container into w as a
+// tarball. The paths in the tarball starts with the base name of from.
+func (c *dockerCont) copyOut(
+	ctx context.Context, from string, w io.Writer,
+) error {
+	q := url.Values{"path": []string{from}}
+	resp, err := c.api.do(ctx, "GET", c.path("/archive"), q, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// copyOutFile copies regular file from in the container to file to.
+func (c *dockerCont) copyOutFile(ctx context.Context, from, to string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.copyOut(ctx, from, pw))
+	}()
+	defer pr.Close()
+
+	tr := tar.NewReader(pr)
+	h, err := tr.Next()
+	if err != nil {
+		return errcode.Annotate(err, "read tarball")
+	}
+	if h.Typeflag != tar.TypeReg {
+		return errcode.InvalidArgf("%q is not a regular file", from)
+	}
+	mode := os.FileMode(h.Mode).Perm()
+	f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, tr); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// remove force removes the container, which kills it if it is running.
+// It does not take a context, so that it can clean up after the build is
+// canceled.
+func (c *dockerCont) remove() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	q := url.Values{"force": []string{"1"}}
+	return c.api.call(ctx, "DELETE", c.path(""), q, nil, nil)
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"shanhu.io/misc/tarutil"
+)
+
+type fakeTarFile struct {
+	name string
+	typ  byte
+	body string
+	link string
+}
+
+func writeFakeTar(w io.Writer, files []*fakeTarFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		h := &tar.Header{
+			Name:     f.name,
+			Typeflag: f.typ,
+			Mode:     0644,
+			Size:     int64(len(f.body)),
+			Linkname: f.link,
+		}
+		if f.typ == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, f.body); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// fakeDocker is a docker daemon that builds a single image or runs a
+// single container.
+type fakeDocker struct {
+	build   url.Values // Query of the build request.
+	create  *dockerContCreate
+	inputs  []string
+	removed bool
+	archive map[string][]*fakeTarFile // Files to copy out.
+
+	removedImages []string
+}
+
+func (d *fakeDocker) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	const cont = "/containers/c1"
+	switch req.Method + " " + req.URL.Path {
+	case "POST /containers/create":
+		d.create = new(dockerContCreate)
+		json.NewDecoder(req.Body).Decode(d.create)
+		json.NewEncoder(w).Encode(map[string]string{"Id": "c1"})
+	case "POST /build", "PUT " + cont + "/archive":
+		tr := tar.NewReader(req.Body)
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				break
+			}
+			d.inputs = append(d.inputs, h.Name)
+		}
+		if req.URL.Path == "/build" {
+			d.build = req.URL.Query()
+			io.WriteString(w, `{"stream": "step 1\n"}`)
+			io.WriteString(w, `{"stream": "done\n"}`)
+		}
+	case "POST " + cont + "/start":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET " + cont + "/logs":
+		msg := "hello\n"
+		var header [8]byte
+		header[0] = 1
+		binary.BigEndian.PutUint32(header[4:], uint32(len(msg)))
+		w.Write(header[:])
+		io.WriteString(w, msg)
+	case "POST " + cont + "/wait":
+		io.WriteString(w, `{"StatusCode": 0}`)
+	case "GET " + cont + "/archive":
+		files, ok := d.archive[req.URL.Query().Get("path")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"message": "no such file"}`)
+			return
+		}
+		writeFakeTar(w, files)
+	case "DELETE " + cont:
+		d.removed = true
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		if req.Method == "DELETE" &&
+			strings.HasPrefix(req.URL.Path, "/images/") {
+			img := strings.TrimPrefix(req.URL.Path, "/images/")
+			d.removedImages = append(d.removedImages, img)
+			io.WriteString(w, `[{"Untagged": "img"}]`)
+			return
+		}
+		http.NotFound(w, req)
+	}
+}
+
+func newFakeDockerEnv(t *testing.T, d *fakeDocker) *env {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "docker.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(d.serveHTTP))
+	s.Listener = lis
+	s.Start()
+	t.Cleanup(s.Close)
+
+	return &env{
+		docker: newDockerAPI(sock),
+		srcDir: filepath.Join(dir, "src"),
+		outDir: filepath.Join(dir, "out"),
+	}
+}
+
+func TestContRun(t *testing.T) {
+	d := &fakeDocker{
+		archive: map[string][]*fakeTarFile{
+			"/out/a.txt": {{name: "a.txt", typ: tar.TypeReg, body: "a"}},
+			"/out/dist": {
+				{name: "dist/", typ: tar.TypeDir},
+				{name: "dist/x.js", typ: tar.TypeReg, body: "x"},
+				{name: "dist/sub/y.js", typ: tar.TypeReg, body: "y"},
+				{name: "dist/z.js", typ: tar.TypeSymlink, link: "x.js"},
+			},
+		},
+	}
+	env := newFakeDockerEnv(t, d)
+
+	ts := tarutil.NewStream()
+	ts.AddString("in.txt", tarutil.ModeMeta(0644), "in")
+	log := new(bytes.Buffer)
+	job := &contRun{
+		image: "img",
+		config: &contConfig{
+			cmd: []string{"true"},
+			env: map[string]string{"B": "2", "A": "1"},
+			mounts: []*contMount{
+				{host: "/src", cont: "/src", readOnly: true},
+			},
+			network:  "none",
+			memory:   1 << 30,
+			nanoCPUs: 1e9,
+			capDrop:  []string{"ALL"},
+		},
+		input:     ts,
+		outs:      []string{"p/a.txt"},
+		outMap:    map[string]string{"p/a.txt": "/out/a.txt"},
+		outDirs:   []string{"p/dist"},
+		outDirMap: map[string]string{"p/dist": "/out/dist"},
+	}
+	ctx := context.Background()
+	if err := job.run(ctx, env, &buildOpts{log: log}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &dockerContCreate{
+		Image: "img",
+		Cmd:   []string{"true"},
+		Env:   []string{"A=1", "B=2"},
+		HostConfig: &dockerHostConfig{
+			Mounts: []*dockerMount{{
+				Type:     "bind",
+				Source:   "/src",
+				Target:   "/src",
+				ReadOnly: true,
+			}},
+			NetworkMode: "none",
+			Memory:      1 << 30,
+			NanoCpus:    1e9,
+			CapDrop:     []string{"ALL"},
+		},
+	}
+	if !reflect.DeepEqual(d.create, want) {
+		t.Errorf("create container got %+v, want %+v", d.create, want)
+	}
+	if !reflect.DeepEqual(d.inputs, []string{"in.txt"}) {
+		t.Errorf("got inputs %q", d.inputs)
+	}
+	if got := log.String(); got != "hello\n" {
+		t.Errorf("got log %q", got)
+	}
+	if !d.removed {
+		t.Error("container not removed")
+	}
+
+	bs, err := os.ReadFile(env.out("p/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "a" {
+		t.Errorf("got output %q", bs)
+	}
+
+	var list []*fileStat
+	bs, err = os.ReadFile(env.out("p/dist.fileset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(bs, &list); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range list {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	wantNames := []string{"p/dist/sub/y.js", "p/dist/x.js", "p/dist/z.js"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got dir outputs %q, want %q", names, wantNames)
+	}
+}
+
+func TestContRunDirEscape(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files []*fakeTarFile
+	}{{
+		name: "absolute link",
+		files: []*fakeTarFile{
+			{name: "dist/etc", typ: tar.TypeSymlink, link: "/etc"},
+		},
+	}, {
+		name: "link outside",
+		files: []*fakeTarFile{
+			{name: "dist/up", typ: tar.TypeSymlink, link: "../../x"},
+		},
+	}, {
+		name: "write through link",
+		files: []*fakeTarFile{
+			{name: "dist/sub/", typ: tar.TypeDir},
+			{name: "dist/d", typ: tar.TypeSymlink, link: "sub"},
+			{name: "dist/d/x", typ: tar.TypeReg, body: "x"},
+		},
+	}, {
+		name: "dot dot name",
+		files: []*fakeTarFile{
+			{name: "dist/../../x", typ: tar.TypeReg, body: "x"},
+		},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			d := &fakeDocker{
+				archive: map[string][]*fakeTarFile{"/out/dist": test.files},
+			}
+			env := newFakeDockerEnv(t, d)
+			job := &contRun{
+				image:     "img",
+				config:    &contConfig{cmd: []string{"true"}},
+				outDirs:   []string{"p/dist"},
+				outDirMap: map[string]string{"p/dist": "/out/dist"},
+			}
+			ctx := context.Background()
+			opts := &buildOpts{log: io.Discard}
+			if err := job.run(ctx, env, opts); err == nil {
+				t.Error("want error, got nil")
+			}
+		})
+	}
+}
+
+func TestBuildImage(t *testing.T) {
+	d := new(fakeDocker)
+	env := newFakeDockerEnv(t, d)
+
+	ts := newArchiveStream()
+	defer ts.Close()
+	ts.AddString("Dockerfile", tarutil.ModeMeta(0644), "FROM scratch")
+	if err := ts.addSymlink("", "link", "Dockerfile"); err != nil {
+		t.Fatal(err)
+	}
+
+	log := new(bytes.Buffer)
+	args := map[string]string{"V": "1"}
+	ctx := context.Background()
+	if err := env.docker.buildImage(ctx, "img:v1", ts, args, log); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.build.Get("t"); got != "img:v1" {
+		t.Errorf("got tag %q", got)
+	}
+	if got := d.build.Get("buildargs"); got != `{"V":"1"}` {
+		t.Errorf("got build args %q", got)
+	}
+	if !reflect.DeepEqual(d.inputs, []string{"Dockerfile", "link"}) {
+		t.Errorf("got build context %q", d.inputs)
+	}
+	if got := log.String(); got != "step 1\ndone\n" {
+		t.Errorf("got build output %q", got)
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	d := new(fakeDocker)
+	env := newFakeDockerEnv(t, d)
+
+	ctx := context.Background()
+	tag := "registry.example.com/p/img:v1"
+	if err := env.docker.removeImage(ctx, tag); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.removedImages, []string{tag}) {
+		t.Errorf("got removed images %q, want %q", d.removedImages, tag)
+	}
+}
@@ -16,11 +16,13 @@
 package caco3
 
 import (
+	"context"
 	"log"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"shanhu.io/misc/errcode"
 	"shanhu.io/misc/jsonutil"
@@ -36,11 +38,13 @@ type dockerBuild struct {
 	dockerfilePath string
 	inputs         []string
 	archInputs     []string
+	archOpts       map[string]*ArchiveOptions
 	prefixDir      string
 	repoTag        string
 	args           map[string]string
 	out            string
 	tarOut         string
+	timeout        time.Duration
 }
 
 func newDockerBuild(env *env, p string, r *DockerBuild) (
@@ -78,6 +82,10 @@ func newDockerBuild(env *env, p string, r *DockerBuild) (
 	for _, input := range r.ArchiveInput {
 		archInputMap[makePath(p, input)] = true
 	}
+	archOpts, err := archiveOptions(p, r.ArchiveOptions, archInputMap)
+	if err != nil {
+		return nil, err
+	}
 
 	prefixDir := r.PrefixDir
 	if prefixDir == "." {
@@ -89,6 +97,11 @@ func newDockerBuild(env *env, p string, r *DockerBuild) (
 		tarOut = dockerTarOut(name)
 	}
 
+	timeout, err := parseTimeout(r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
 	return &dockerBuild{
 		name:           name,
 		rule:           r,
@@ -96,11 +109,13 @@ func newDockerBuild(env *env, p string, r *DockerBuild) (
 		fromRuleSums:   fromRuleSums,
 		inputs:         strutil.SortedList(inputMap),
 		archInputs:     strutil.SortedList(archInputMap),
+		archOpts:       archOpts,
 		prefixDir:      prefixDir,
 		repoTag:        repoTag,
 		args:           args,
 		out:            dockerSumOut(name),
 		tarOut:         tarOut,
+		timeout:        timeout,
 	}, nil
 }
 
@@ -110,11 +125,18 @@ func (b *dockerBuild) meta(env *env) (*buildRuleMeta, error) {
 		Args       map[string]string `json:",omitempty"`
 		PrefixDir  string            `json:",omitempty"`
 		OutputTar  bool              `json:",omitempty"`
+
+		ArchiveOptions map[string]*ArchiveOptions `json:",omitempty"`
+
+		// Mapped by the docker registry settings of the workspace.
+		RepoTag string
 	}{
-		Dockerfile: b.dockerfilePath,
-		Args:       b.args,
-		PrefixDir:  b.prefixDir,
-		OutputTar:  b.rule.OutputTar,
+		Dockerfile:     b.dockerfilePath,
+		Args:           b.args,
+		PrefixDir:      b.prefixDir,
+		OutputTar:      b.rule.OutputTar,
+		ArchiveOptions: b.archOpts,
+		RepoTag:        b.repoTag,
 	}
 
 	digest, err := makeDigest(ruleDockerBuild, b.name, &dat)
@@ -141,52 +163,30 @@ func (b *dockerBuild) meta(env *env) (*buildRuleMeta, error) {
 	}, nil
 }
 
-func (b *dockerBuild) build(env *env, opts *buildOpts) error {
+func (b *dockerBuild) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, b.timeout, func(ctx context.Context) error {
+		return b.run(ctx, env, opts)
+	})
+}
+
+func (b *dockerBuild) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
 	dockerfileBytes, err := os.ReadFile(env.src(b.dockerfilePath))
 	if err != nil {
 		return errcode.Annotate(err, "read Dockerfile")
 	}
 	df := string(dockerfileBytes)
 
-	ts := dock.NewTarStream(df)
-	files := make(map[string]string)
+	ts := newArchiveStream()
+	defer ts.Close()
+	ts.AddString("Dockerfile", tarutil.ModeMeta(0644), df)
 
-	for _, in := range b.inputs {
-		switch typ := env.nodeType(in); typ {
-		case "":
-			return errcode.Internalf("file %q not found", in)
-		case nodeSrc:
-			files[in] = env.src(in)
-		case nodeOut:
-			files[in] = env.out(in)
-		case nodeRule:
-			fileSet, err := referenceFileSetOut(env, in)
-			if err != nil {
-				return errcode.Annotatef(err, "input %q", in)
-			}
-			fileSetFile := env.out(fileSet)
-			var list []*fileStat
-			if err := jsonutil.ReadFile(fileSetFile, &list); err != nil {
-				return errcode.Annotatef(err, "read file set %q", in)
-			}
-			for _, f := range list {
-				var fp string
-				switch f.Type {
-				case fileTypeSrc:
-					fp = env.src(f.Name)
-				case fileTypeOut:
-					fp = env.out(f.Name)
-				default:
-					return errcode.Internalf(
-						"invalid file type %q of %q ini set %q",
-						f.Type, f.Name, in,
-					)
-				}
-				files[f.Name] = fp
-			}
-		default:
-			return errcode.Internalf("unknown type %q", typ)
-		}
+	files, err := inputFiles(env, b.inputs)
+	if err != nil {
+		return err
 	}
 
 	var names []string
@@ -236,22 +236,21 @@ func (b *dockerBuild) build(env *env, opts *buildOpts) error {
 		if dir == "." {
 			dir = ""
 		}
-		if strings.HasSuffix(base, ".zip") {
-			ts.AddZipFile(dir, fp)
-		} else {
-			return errcode.InvalidArgf("unknown archive type %q", base)
+		if err := ts.addArchive(dir, base, fp, b.archOpts[ar]); err != nil {
+			return errcode.Annotatef(err, "archive input %q", ar)
 		}
 	}
 
 	repo, tag := parseRepoTag(b.repoTag)
 	rt := repoTag(repo, tag)
 
-	config := &dock.BuildConfig{
-		Files:    ts,
-		Args:     b.args,
-		UseCache: true, // TODO(h8liu): read from option.
-	}
-	if err := dock.BuildImageConfig(env.dock, rt, config); err != nil {
+	// Canceling closes the request, which stops the build in the docker
+	// daemon. The build always uses the cache. TODO(h8liu): read from
+	// option.
+	endSpan := opts.trace.span("build image", "docker")
+	err = env.docker.buildImage(ctx, rt, ts, b.args, opts.log)
+	endSpan()
+	if err != nil {
 		return err
 	}
 
@@ -276,7 +275,10 @@ func (b *dockerBuild) build(env *env, opts *buildOpts) error {
 		if err != nil {
 			return errcode.Annotate(err, "prepare tar output")
 		}
-		if err := dock.SaveImageGz(env.dock, sum.ID, out); err != nil {
+		defer opts.trace.span("save image", "docker")()
+		if err := writeUntilDone(ctx, out, func(tmp string) error {
+			return dock.SaveImageGz(env.dock, sum.ID, tmp)
+		}); err != nil {
 			return errcode.Annotate(err, "save image as tar")
 		}
 	}
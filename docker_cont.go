@@ -0,0 +1,267 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/tarutil"
+)
+
+// contRun runs a command in a new docker container, and copies the
+// output files out after the command exits.
+type contRun struct {
+	image  string // Repo tag of the image.
+	config *contConfig
+
+	input io.WriterTo // Tarball copied into the container; optional.
+
+	outs   []string          // Output files.
+	outMap map[string]string // Map from output to file in the container.
+
+	outDirs   []string          // Output directories.
+	outDirMap map[string]string // Map from output to dir in the container.
+}
+
+func (r *contRun) run(ctx context.Context, env *env, opts *buildOpts) error {
+	// The requests to the docker daemon end when ctx ends, and the
+	// container is then removed, which also kills it.
+	cont, err := env.docker.createCont(ctx, r.image, r.config)
+	if err != nil {
+		return errcode.Annotate(err, "create container")
+	}
+	defer func() {
+		if err := cont.remove(); err != nil {
+			log.Printf("remove container: %s", err)
+		}
+	}()
+
+	if r.input != nil {
+		endSpan := opts.trace.span("copy inputs", "docker")
+		err := cont.copyIn(ctx, r.input, "/")
+		endSpan()
+		if err != nil {
+			return errcode.Annotate(err, "copy input")
+		}
+	}
+
+	endRunSpan := opts.trace.span("run container", "docker")
+	if err := cont.start(ctx); err != nil {
+		return errcode.Annotate(err, "start container")
+	}
+	if err := cont.followLogs(ctx, opts.log); err != nil {
+		return errcode.Annotate(err, "stream logs")
+	}
+
+	status, err := cont.wait(ctx)
+	if err != nil {
+		return errcode.Annotate(err, "wait container")
+	}
+	endRunSpan()
+
+	defer opts.trace.span("copy outputs", "docker")()
+	for _, out := range r.outs {
+		from := r.outMap[out]
+		to := out
+
+		f, err := env.prepareOut(to)
+		if err != nil {
+			return errcode.Annotatef(err, "prepare output: %s", to)
+		}
+
+		if err := cont.copyOutFile(ctx, from, f); err != nil {
+			if status == 0 {
+				return errcode.Annotatef(err, "copy %s", to)
+			}
+			log.Printf("copy %s: %s", to, err)
+		}
+	}
+
+	for _, dir := range r.outDirs {
+		from := r.outDirMap[dir]
+		if err := copyOutDir(ctx, env, cont, from, dir); err != nil {
+			if status == 0 {
+				return errcode.Annotatef(err, "copy dir %s", dir)
+			}
+			log.Printf("copy dir %s: %s", dir, err)
+			continue
+		}
+		if err := writeDirFileSet(env, dir, fileSetOut(dir)); err != nil {
+			return errcode.Annotatef(err, "list dir %s", dir)
+		}
+	}
+
+	if status != 0 {
+		return errcode.Internalf("exit with %d", status)
+	}
+	return nil
+}
+
+// copyOutDir copies directory from in the container to output directory
+// dir. Existing files in dir are removed first.
+func copyOutDir(
+	ctx context.Context, env *env, cont *dockerCont, from, dir string,
+) error {
+	to := env.out(dir)
+	if err := os.RemoveAll(to); err != nil {
+		return errcode.Annotate(err, "remove old outputs")
+	}
+	if err := os.MkdirAll(to, 0700); err != nil {
+		return errcode.Annotate(err, "make output dir")
+	}
+	toReal, err := filepath.EvalSymlinks(to)
+	if err != nil {
+		return errcode.Annotate(err, "resolve output dir")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(cont.copyOut(ctx, from, pw))
+	}()
+	defer pr.Close() // Unblocks the copying when returning early.
+
+	// The tarball from docker has the base name of the copied directory
+	// as the first path component.
+	tr := tar.NewReader(pr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errcode.Annotate(err, "read tarball")
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(h.Name, "./"), "/")
+		if !fs.ValidPath(name) {
+			return errcode.InvalidArgf("invalid file name %q", h.Name)
+		}
+		_, name, _ = strings.Cut(name, "/")
+		if name == "" {
+			continue // The directory itself.
+		}
+		f := filepath.Join(to, filepath.FromSlash(name))
+		mode := fs.FileMode(h.Mode).Perm()
+
+		if err := checkParentDir(to, toReal, name); err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeDir {
+			// Never write through an existing symlink.
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(f, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+				return err
+			}
+			if err := writeTarEntry(f, mode, tr); err != nil {
+				return errcode.Annotatef(err, "write %q", name)
+			}
+		case tar.TypeSymlink:
+			if err := checkSymlink(name, h.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+				return err
+			}
+			if err := os.Symlink(h.Linkname, f); err != nil {
+				return err
+			}
+		default:
+			return errcode.InvalidArgf(
+				"%q is not a regular file, directory or symlink", name,
+			)
+		}
+	}
+	return nil
+}
+
+// checkParentDir checks that the parent directories of file name in dir
+// are not symlinks, so that writing the file never leaves dir. dirReal is
+// the real path of dir.
+func checkParentDir(dir, dirReal, name string) error {
+	p := filepath.Dir(filepath.Join(dir, filepath.FromSlash(name)))
+	for { // Find the deepest existing parent.
+		_, err := os.Lstat(p)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		p = filepath.Dir(p)
+	}
+
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	if real != filepath.Join(dirReal, rel) {
+		return errcode.InvalidArgf("parent of %q is a symlink", name)
+	}
+	return nil
+}
+
+func writeTarEntry(f string, mode fs.FileMode, r io.Reader) error {
+	out, err := os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// srcTarStream makes a tarball stream of source files, with the files
+// placed under directory dir in the tarball.
+func srcTarStream(env *env, files []string, dir string) (
+	*tarutil.Stream, error,
+) {
+	ts := tarutil.NewStream()
+	for _, f := range files {
+		fp := env.src(f)
+		info, err := os.Stat(fp)
+		if err != nil {
+			return nil, errcode.Annotatef(err, "stat %q", f)
+		}
+		meta := tarutil.ModeMeta(int64(info.Mode().Perm()))
+		ts.AddFile(path.Join(dir, f), meta, fp)
+	}
+	return ts, nil
+}
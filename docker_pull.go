@@ -16,6 +16,7 @@
 package caco3
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"strings"
@@ -117,8 +118,17 @@ func (p *dockerPull) pull(env *env) (*dockerSum, error) {
 	return sum, nil
 }
 
-func (p *dockerPull) build(env *env, opts *buildOpts) error {
-	sum, err := p.pull(env)
+func (p *dockerPull) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	endSpan := opts.trace.span("pull image", "docker")
+	var sum *dockerSum
+	err := runUntilDone(ctx, func() error {
+		s, err := p.pull(env)
+		sum = s
+		return err
+	})
+	endSpan()
 	if err != nil {
 		return err
 	}
@@ -136,7 +146,10 @@ func (p *dockerPull) build(env *env, opts *buildOpts) error {
 		if err != nil {
 			return errcode.Annotate(err, "prepare tar output")
 		}
-		if err := dock.SaveImageGz(env.dock, sum.ID, out); err != nil {
+		defer opts.trace.span("save image", "docker")()
+		if err := writeUntilDone(ctx, out, func(tmp string) error {
+			return dock.SaveImageGz(env.dock, sum.ID, tmp)
+		}); err != nil {
 			return errcode.Annotate(err, "save image as tar")
 		}
 	}
@@ -144,7 +157,19 @@ func (p *dockerPull) build(env *env, opts *buildOpts) error {
 }
 
 func (p *dockerPull) meta(env *env) (*buildRuleMeta, error) {
-	digest, err := makeDigest(ruleDockerPull, p.name, p.rule)
+	rule := *p.rule
+	clearNonOutputFields(&rule)
+
+	dat := struct {
+		Rule *DockerPull
+
+		// Mapped by the docker registry settings of the workspace.
+		RepoTag string
+	}{
+		Rule:    &rule,
+		RepoTag: p.repoTag,
+	}
+	digest, err := makeDigest(ruleDockerPull, p.name, &dat)
 	if err != nil {
 		return nil, errcode.Annotate(err, "digest")
 	}
@@ -16,32 +16,99 @@
 package caco3
 
 import (
-	"log"
+	"context"
+	"math"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"shanhu.io/misc/errcode"
 	"shanhu.io/misc/strutil"
 	"shanhu.io/misc/tarutil"
-	"shanhu.io/virgo/dock"
 )
 
 type dockerRun struct {
-	name    string
-	rule    *DockerRun
-	image   string
-	ins     map[string]string
-	archIns map[string]string
-	deps    []string
-	outs    []string
-	outMap  map[string]string
-	envs    map[string]string
+	name     string
+	rule     *DockerRun
+	image    string
+	ins      map[string]string
+	archIns  map[string]string
+	archOpts map[string]*ArchiveOptions
+	deps     []string
+	outs     []string
+	outMap   map[string]string
+	outDirs  []string
+	dirMap   map[string]string
+	envs     map[string]string
+	timeout  time.Duration
+
+	network  string
+	memory   int64
+	nanoCPUs int64
 }
 
-func newDockerRun(env *env, p string, r *DockerRun) *dockerRun {
+// parseMemory parses a memory size like "512m", "512mb" or "1.5g" into
+// bytes. The unit can be "k", "m", "g" or "t", optionally followed by
+// "b", and is bytes when omitted or just "b". Empty string means no
+// limit, and is parsed as 0.
+func parseMemory(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimSuffix(strings.ToLower(s), "b")
+	unit := float64(1)
+	if n := len(num); n > 0 {
+		switch num[n-1] {
+		case 'k':
+			unit = 1 << 10
+		case 'm':
+			unit = 1 << 20
+		case 'g':
+			unit = 1 << 30
+		case 't':
+			unit = 1 << 40
+		}
+		if unit != 1 {
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errcode.InvalidArgf("invalid memory size %q", s)
+	}
+	n := f * unit
+	if n < 1 || n > math.MaxInt64 {
+		return 0, errcode.InvalidArgf("memory size %q out of range", s)
+	}
+	return int64(n), nil
+}
+
+func newDockerRun(env *env, p string, r *DockerRun) (*dockerRun, error) {
 	name := makeRelPath(p, r.Name)
 
+	timeout, err := parseTimeout(r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	network := r.Network
+	switch network {
+	case "":
+		network = "none"
+	case "none", "bridge", "host":
+	default:
+		return nil, errcode.InvalidArgf("invalid network %q", network)
+	}
+	memory, err := parseMemory(r.Memory)
+	if err != nil {
+		return nil, err
+	}
+	if r.CPUs < 0 {
+		return nil, errcode.InvalidArgf("negative CPUs %v", r.CPUs)
+	}
+
 	image := makePath(p, r.Image)
 	var deps []string
 	deps = append(deps, dockerSumOut(image))
@@ -58,11 +125,17 @@ func newDockerRun(env *env, p string, r *DockerRun) *dockerRun {
 		depsMap[inPath] = true
 	}
 	archIns := make(map[string]string)
+	archInSet := make(map[string]bool)
 	for f, v := range r.ArchiveInput {
 		inPath := makePath(p, f)
 		archIns[inPath] = v
+		archInSet[inPath] = true
 		depsMap[inPath] = true
 	}
+	archOpts, err := archiveOptions(p, r.ArchiveOptions, archInSet)
+	if err != nil {
+		return nil, err
+	}
 	deps = append(deps, strutil.SortedList(depsMap)...)
 
 	var outs []string
@@ -74,52 +147,102 @@ func newDockerRun(env *env, p string, r *DockerRun) *dockerRun {
 	}
 	outs = strutil.SortedList(strutil.MakeSet(outs))
 
-	return &dockerRun{
-		name:    name,
-		rule:    r,
-		image:   image,
-		ins:     ins,
-		archIns: archIns,
-		deps:    deps,
-		outs:    outs,
-		outMap:  outMap,
-		envs:    makeDockerVars(r.Envs),
+	dirMap := make(map[string]string)
+	for d, v := range r.OutputDir {
+		dirMap[makeRelPath(p, d)] = v
+	}
+	var outDirs []string
+	for d := range dirMap {
+		outDirs = append(outDirs, d)
 	}
+	sort.Strings(outDirs)
+
+	return &dockerRun{
+		name:     name,
+		rule:     r,
+		image:    image,
+		ins:      ins,
+		archIns:  archIns,
+		archOpts: archOpts,
+		deps:     deps,
+		outs:     outs,
+		outMap:   outMap,
+		outDirs:  outDirs,
+		dirMap:   dirMap,
+		envs:     makeDockerVars(r.Envs),
+		timeout:  timeout,
+		network:  network,
+		memory:   memory,
+		nanoCPUs: int64(r.CPUs * 1e9),
+	}, nil
 }
 
 func (r *dockerRun) meta(env *env) (*buildRuleMeta, error) {
+	rule := *r.rule
+	clearNonOutputFields(&rule)
+
+	// The network is digested after resolving the default, so that
+	// changing the default also changes the digest.
 	dat := struct {
-		Rule *DockerRun
-		Envs map[string]string `json:",omitempty"`
+		Rule    *DockerRun
+		Envs    map[string]string `json:",omitempty"`
+		Network string
 	}{
-		Rule: r.rule,
-		Envs: r.envs,
+		Rule:    &rule,
+		Envs:    r.envs,
+		Network: r.network,
 	}
 	digest, err := makeDigest(ruleDockerRun, r.name, &dat)
 	if err != nil {
 		return nil, errcode.Annotate(err, "digest")
 	}
 
+	var outs []string
+	outs = append(outs, r.outs...)
+	var dirOuts []string
+	for _, d := range r.outDirs {
+		dirOuts = append(dirOuts, fileSetOut(d))
+	}
+	outs = append(outs, dirOuts...)
+
 	return &buildRuleMeta{
-		name:   r.name,
-		outs:   r.outs,
-		deps:   r.deps,
-		digest: digest,
+		name:    r.name,
+		outs:    outs,
+		deps:    r.deps,
+		dirOuts: dirOuts,
+		digest:  digest,
 	}, nil
 }
 
-func (r *dockerRun) build(env *env, opts *buildOpts) error {
-	contConfig := &dock.ContConfig{
-		Cmd:     r.rule.Command,
-		WorkDir: r.rule.WorkDir,
-		Env:     r.envs,
+func (r *dockerRun) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, r.timeout, func(ctx context.Context) error {
+		return r.run(ctx, env, opts)
+	})
+}
+
+func (r *dockerRun) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	config := &contConfig{
+		cmd:     r.rule.Command,
+		workDir: r.rule.WorkDir,
+		env:     r.envs,
+
+		network:        r.network,
+		memory:         r.memory,
+		nanoCPUs:       r.nanoCPUs,
+		tmpfs:          r.rule.Tmpfs,
+		readOnlyRootfs: r.rule.ReadOnlyRootfs,
+		capDrop:        r.rule.CapDrop,
 	}
 
 	if m := r.rule.MountWorkspace; m != "" {
-		contConfig.Mounts = append(contConfig.Mounts, &dock.ContMount{
-			Host:     env.rootDir,
-			Cont:     m,
-			ReadOnly: true,
+		config.mounts = append(config.mounts, &contMount{
+			host:     env.rootDir,
+			cont:     m,
+			readOnly: true,
 		})
 	}
 
@@ -128,16 +251,19 @@ func (r *dockerRun) build(env *env, opts *buildOpts) error {
 		return errcode.Annotate(err, "map image name")
 	}
 
-	c := env.dock
+	job := &contRun{
+		image:  img,
+		config: config,
+		outs:   r.outs,
+		outMap: r.outMap,
 
-	cont, err := dock.CreateCont(c, img, contConfig)
-	if err != nil {
-		return errcode.Annotate(err, "create container")
+		outDirs:   r.outDirs,
+		outDirMap: r.dirMap,
 	}
-	defer cont.Drop()
 
 	if len(r.ins)+len(r.archIns) > 0 {
-		ts := tarutil.NewStream()
+		ts := newArchiveStream()
+		defer ts.Close()
 
 		var ins []string
 		for in := range r.ins {
@@ -182,49 +308,13 @@ func (r *dockerRun) build(env *env, opts *buildOpts) error {
 			}
 			dest := r.archIns[in]
 			base := path.Base(in)
-			if strings.HasSuffix(base, ".zip") {
-				ts.AddZipFile(dest, f)
-			} else {
-				return errcode.InvalidArgf("unknown archive type %q", base)
-			}
-		}
-
-		if err := dock.CopyInTarStream(cont, ts, "/"); err != nil {
-			return errcode.Annotate(err, "copy input")
-		}
-	}
-
-	if err := cont.Start(); err != nil {
-		return errcode.Annotate(err, "start container")
-	}
-	if err := cont.FollowLogs(opts.log); err != nil {
-		return errcode.Annotate(err, "stream logs")
-	}
-
-	status, err := cont.Wait(dock.NotRunning)
-	if err != nil {
-		return errcode.Annotate(err, "wait container")
-	}
-	for _, out := range r.outs {
-		from := r.outMap[out]
-		to := out
-
-		f, err := env.prepareOut(to)
-		if err != nil {
-			return errcode.Annotatef(err, "prepare output: %s", to)
-		}
-
-		if err := cont.CopyOutFile(from, f); err != nil {
-			if status == 0 {
-				return errcode.Annotatef(err, "copy %s", to)
+			opts := r.archOpts[in]
+			if err := ts.addArchive(dest, base, f, opts); err != nil {
+				return errcode.Annotatef(err, "archive input %q", in)
 			}
-			log.Printf("copy %s: %s", to, err)
 		}
+		job.input = ts
 	}
 
-	if status != 0 {
-		return errcode.Internalf("exit with %d", status)
-	}
-
-	return nil
+	return job.run(ctx, env, opts)
 }
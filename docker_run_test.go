@@ -0,0 +1,62 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want int64
+	}{
+		{"", 0},
+		{"1", 1},
+		{"100b", 100},
+		{"2k", 2 << 10},
+		{"512m", 512 << 20},
+		{"512M", 512 << 20},
+		{"2g", 2 << 30},
+		{"1.5g", 3 << 29},
+		{"0.5k", 512},
+		{"1kb", 1 << 10},
+		{"512mb", 512 << 20},
+		{"512MB", 512 << 20},
+		{"2gb", 2 << 30},
+		{"1t", 1 << 40},
+		{"1tb", 1 << 40},
+		{"0.5T", 1 << 39},
+	} {
+		got, err := parseMemory(test.s)
+		if err != nil {
+			t.Errorf("parseMemory(%q): %s", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseMemory(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+
+	for _, s := range []string{
+		"0", "0g", "-1m", "g", "12x", "1.5.g", "NaN", "Inf", "1e30g",
+		"b", "gb", "1bb", "1bm", "1e30tb",
+	} {
+		if _, err := parseMemory(s); err == nil {
+			t.Errorf("parseMemory(%q) got no error", s)
+		}
+	}
+}
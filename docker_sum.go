@@ -34,7 +34,9 @@ func newDockerSum(repo, tag, id string) *dockerSum {
 	}
 }
 
-func dockerSumOut(name string) string { return name + ".dockersum" }
+const dockerSumExt = ".dockersum"
+
+func dockerSumOut(name string) string { return name + dockerSumExt }
 
 func dockerTarOut(name string) string { return name + ".tar.gz" }
 
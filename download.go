@@ -16,6 +16,7 @@
 package caco3
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
@@ -23,16 +24,18 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"shanhu.io/misc/errcode"
 )
 
 type download struct {
-	name   string
-	url    *url.URL
-	rule   *Download
-	sha256 string
-	out    string
+	name    string
+	url     *url.URL
+	rule    *Download
+	sha256  string
+	out     string
+	timeout time.Duration
 }
 
 func newDownload(env *env, p string, r *Download) (*download, error) {
@@ -52,12 +55,18 @@ func newDownload(env *env, p string, r *Download) (*download, error) {
 		return nil, errcode.InvalidArgf("output not specified")
 	}
 
+	timeout, err := parseTimeout(r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
 	return &download{
-		name:   name,
-		url:    u,
-		rule:   r,
-		sha256: strings.TrimPrefix(r.Checksum, sha256Prefix),
-		out:    makeRelPath(p, r.Output),
+		name:    name,
+		url:     u,
+		rule:    r,
+		sha256:  strings.TrimPrefix(r.Checksum, sha256Prefix),
+		out:     makeRelPath(p, r.Output),
+		timeout: timeout,
 	}, nil
 }
 
@@ -103,15 +112,25 @@ func downloadToFile(f string, r io.Reader) (string, error) {
 	return hex.EncodeToString(sum[:]), nil
 }
 
-func (d *download) build(env *env, opts *buildOpts) error {
+func (d *download) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, d.timeout, func(ctx context.Context) error {
+		return d.run(ctx, env)
+	})
+}
+
+func (d *download) run(ctx context.Context, env *env) error {
 	out, err := env.prepareOut(d.out)
 	if err != nil {
 		return errcode.Annotate(err, "prepare out")
 	}
 
-	req := &http.Request{
-		Method: http.MethodGet,
-		URL:    d.url,
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodGet, d.url.String(), nil,
+	)
+	if err != nil {
+		return errcode.Annotate(err, "make request")
 	}
 	client := new(http.Client)
 	resp, err := client.Do(req)
@@ -19,14 +19,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 
 	"shanhu.io/misc/errcode"
 	"shanhu.io/virgo/dock"
 )
 
 type env struct {
-	dock *dock.Client
+	dock   *dock.Client
+	docker *dockerAPI // For the calls that package dock does not have.
 
 	rootDir     string
 	workDir     string
@@ -37,6 +37,11 @@ type env struct {
 
 	workspace *Workspace // Lazily loaded.
 
+	// Digests file contents when not nil.
+	hasher *fileHasher
+
+	goHostEnvs *goHostEnvs
+
 	nodeType func(name string) string
 	ruleType func(name string) string
 }
@@ -71,26 +76,12 @@ func (e *env) src(ps ...string) string {
 }
 
 func (e *env) nameToRepoTag(name string) (string, error) {
-	parts := strings.Split(name, "/")
-	if len(parts) == 0 {
+	if name == "" {
 		return "", errcode.InvalidArgf("empty name")
 	}
-	if len(parts) != 4 {
-		return "", errcode.InvalidArgf("invalid name %q", name)
-	}
-
-	domain := parts[0]
-	project := parts[1]
-	dockers := parts[2]
-	base := parts[3]
-
-	if dockers != "dockers" && !strings.HasSuffix(dockers, "-dockers") {
-		return "", errcode.InvalidArgf("not a docker image name: %q", name)
-	}
-
-	if domain == "shanhu.io" {
-		domain = "cr.shanhu.io"
+	r := defaultDockerRegistry()
+	if e.workspace != nil && e.workspace.DockerRegistry != nil {
+		r = e.workspace.DockerRegistry
 	}
-
-	return path.Join(domain, project, base), nil
+	return r.repoTag(name)
 }
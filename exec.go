@@ -0,0 +1,252 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/strutil"
+)
+
+// execDirName is the name of the directory in the output directory that
+// contains the scratch directories of exec rules.
+const execDirName = "_exec"
+
+type execRule struct {
+	name    string
+	rule    *Exec
+	ins     map[string]string // Input node to path in the scratch dir.
+	deps    []string
+	outs    []string
+	outMap  map[string]string // Output node to path in the scratch dir.
+	envs    map[string]string
+	timeout time.Duration
+}
+
+func newExec(env *env, p string, r *Exec) (*execRule, error) {
+	name := makeRelPath(p, r.Name)
+	if len(r.Command) == 0 {
+		return nil, errcode.InvalidArgf("command is empty")
+	}
+
+	timeout, err := parseTimeout(r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	depsMap := make(map[string]bool)
+	for _, d := range r.Deps {
+		depsMap[makePath(p, d)] = true
+	}
+
+	ins := make(map[string]string)
+	for f, v := range r.Input {
+		inPath := makePath(p, f)
+		ins[inPath] = makeRelPath("", v)
+		depsMap[inPath] = true
+	}
+
+	var outs []string
+	outMap := make(map[string]string)
+	for f, v := range r.Output {
+		outPath := makeRelPath(p, f)
+		outs = append(outs, outPath)
+		outMap[outPath] = makeRelPath("", v)
+	}
+
+	return &execRule{
+		name:    name,
+		rule:    r,
+		ins:     ins,
+		deps:    strutil.SortedList(depsMap),
+		outs:    strutil.SortedList(strutil.MakeSet(outs)),
+		outMap:  outMap,
+		envs:    makeDockerVars(r.Envs),
+		timeout: timeout,
+	}, nil
+}
+
+func (r *execRule) meta(env *env) (*buildRuleMeta, error) {
+	rule := *r.rule
+	clearNonOutputFields(&rule)
+
+	dat := struct {
+		Rule *Exec
+		Envs map[string]string `json:",omitempty"`
+	}{
+		Rule: &rule,
+		Envs: r.envs,
+	}
+	digest, err := makeDigest(ruleExec, r.name, &dat)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+
+	return &buildRuleMeta{
+		name:   r.name,
+		outs:   r.outs,
+		deps:   r.deps,
+		digest: digest,
+	}, nil
+}
+
+// copyInput copies an input file. Unlike copyFile, symlinks are copied
+// as symlinks.
+func copyInput(from, to string) error {
+	info, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return copyFile(from, to)
+	}
+	target, err := os.Readlink(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	return os.Symlink(target, to)
+}
+
+func copyFile(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errcode.InvalidArgf("%q is not a regular file", from)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dest, err := os.OpenFile(
+		to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm(),
+	)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	if _, err := io.Copy(dest, src); err != nil {
+		return err
+	}
+	return dest.Close()
+}
+
+func (r *execRule) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, r.timeout, func(ctx context.Context) error {
+		return r.run(ctx, env, opts)
+	})
+}
+
+func (r *execRule) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	dir := env.out(execDirName, r.name)
+	if err := os.RemoveAll(dir); err != nil {
+		return errcode.Annotate(err, "clear scratch dir")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errcode.Annotate(err, "make scratch dir")
+	}
+
+	var ins []string
+	for in := range r.ins {
+		ins = append(ins, in)
+	}
+	sort.Strings(ins)
+
+	endSpan := opts.trace.span("copy inputs", "exec")
+	for _, in := range ins {
+		files, err := inputFiles(env, []string{in})
+		if err != nil {
+			return errcode.Annotatef(err, "input %q", in)
+		}
+		dest := r.ins[in]
+		isSet := isFileSetInput(env, in)
+		for name, f := range files {
+			p := dest
+			if isSet {
+				p = path.Join(dest, name)
+			}
+			to := filepath.Join(dir, filepath.FromSlash(p))
+			if err := copyInput(f, to); err != nil {
+				return errcode.Annotatef(err, "copy input %q", name)
+			}
+		}
+	}
+	endSpan()
+
+	var envs []string
+	if p, ok := os.LookupEnv("PATH"); ok {
+		envs = append(envs, "PATH="+p)
+	}
+	var keys []string
+	for k := range r.envs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		envs = append(envs, k+"="+r.envs[k])
+	}
+
+	cmd := exec.CommandContext(ctx, r.rule.Command[0], r.rule.Command[1:]...)
+	cmd.Dir = dir
+	cmd.Env = envs
+	cmd.Stdout = opts.log
+	cmd.Stderr = opts.log
+
+	endSpan = opts.trace.span("run command", "exec")
+	err := cmd.Run()
+	endSpan()
+	if err != nil {
+		return errcode.Annotate(err, "run command")
+	}
+
+	for _, out := range r.outs {
+		from := filepath.Join(dir, filepath.FromSlash(r.outMap[out]))
+		to, err := env.prepareOut(out)
+		if err != nil {
+			return errcode.Annotatef(err, "prepare output: %s", out)
+		}
+		if err := copyFile(from, to); err != nil {
+			return errcode.Annotatef(err, "copy output %s", out)
+		}
+	}
+
+	// The scratch dir is kept on failures for debugging.
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"shanhu.io/misc/osutil"
+)
+
+func TestExec(t *testing.T) {
+	env := &env{
+		srcDir: t.TempDir(),
+		outDir: t.TempDir(),
+		nodeType: func(name string) string {
+			if name == "p/a.txt" {
+				return nodeSrc
+			}
+			return ""
+		},
+	}
+	if err := os.MkdirAll(env.src("p"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(env.src("p/a.txt"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newExec(env, "p", &Exec{
+		Name: "gen",
+		Command: []string{
+			"sh", "-c", "mkdir sub && cat in/a.txt > sub/b.txt",
+		},
+		Input:  map[string]string{"a.txt": "in/a.txt"},
+		Output: map[string]string{"b.txt": "sub/b.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	opts := &buildOpts{log: io.Discard}
+	if err := r.build(ctx, env, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := os.ReadFile(env.out("p/b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "a" {
+		t.Errorf("got output %q, want %q", bs, "a")
+	}
+	scratch := env.out(execDirName, "p/gen")
+	if exist, err := osutil.Exist(scratch); err != nil {
+		t.Fatal(err)
+	} else if exist {
+		t.Errorf("scratch dir %q not removed", scratch)
+	}
+
+	// On failures, the scratch dir is kept for debugging.
+	failed, err := newExec(env, "p", &Exec{
+		Name:    "fail",
+		Command: []string{"sh", "-c", "echo x > x.txt; exit 1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := failed.build(ctx, env, opts); err == nil {
+		t.Fatal("failing command succeeded")
+	}
+	f := filepath.Join(env.out(execDirName, "p/fail"), "x.txt")
+	if _, err := os.Stat(f); err != nil {
+		t.Fatalf("scratch dir not kept: %s", err)
+	}
+
+	// GC removes the scratch dirs, and keeps the outputs.
+	b := &Builder{env: env, opts: new(buildOpts)}
+	outs := map[string]bool{"p/b.txt": true}
+	orphans, err := b.gcOutputs(outs, new(gcRefs), new(GCOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{execDirName}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("got orphans %q, want %q", orphans, want)
+	}
+	if exist, err := osutil.Exist(env.out(execDirName)); err != nil {
+		t.Fatal(err)
+	} else if exist {
+		t.Error("scratch dirs not removed")
+	}
+	if _, err := os.Stat(env.out("p/b.txt")); err != nil {
+		t.Errorf("output removed: %s", err)
+	}
+}
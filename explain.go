@@ -0,0 +1,338 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+// Change explains why a node is changed.
+type Change struct {
+	Node    string
+	Reasons []string
+
+	// Changes of the dependencies that cause this change.
+	Deps []*Change `json:",omitempty"`
+}
+
+func (c *Change) addf(f string, args ...interface{}) {
+	c.Reasons = append(c.Reasons, fmt.Sprintf(f, args...))
+}
+
+type explainer struct {
+	cache    *buildCache
+	digester *digester
+	seen     map[string]bool // Nodes already explained.
+}
+
+// findRecord finds the record of node name that has the given digest.
+func (x *explainer) findRecord(name, digest string) (*nodeRecord, error) {
+	recs, err := x.cache.getRecords(name)
+	if err != nil {
+		return nil, err
+	}
+	if recs == nil {
+		return nil, nil
+	}
+	for _, rec := range []*nodeRecord{recs.Cur, recs.Prev} {
+		if rec != nil && rec.Digest == digest {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+const maxExplainValueLen = 60
+
+func explainValue(bs json.RawMessage) string {
+	if len(bs) == 0 {
+		return "<none>"
+	}
+	buf := new(bytes.Buffer)
+	if err := json.Compact(buf, bs); err != nil {
+		return string(bs)
+	}
+	s := buf.String()
+	if len(s) > maxExplainValueLen {
+		return s[:maxExplainValueLen] + "..."
+	}
+	return s
+}
+
+// explainDef explains the changed fields of rule definitions.
+func explainDef(c *Change, cur, base json.RawMessage) {
+	curFields := make(map[string]json.RawMessage)
+	baseFields := make(map[string]json.RawMessage)
+	if len(cur) == 0 || len(base) == 0 ||
+		json.Unmarshal(cur, &curFields) != nil ||
+		json.Unmarshal(base, &baseFields) != nil {
+		c.addf("rule changed")
+		return
+	}
+
+	keys := make(map[string]bool)
+	for k := range curFields {
+		keys[k] = true
+	}
+	for k := range baseFields {
+		keys[k] = true
+	}
+	var names []string
+	for k := range keys {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, k := range names {
+		v, vBase := curFields[k], baseFields[k]
+		if bytes.Equal(v, vBase) {
+			continue
+		}
+		changed = true
+		c.addf(
+			"rule field %s: %s -> %s",
+			k, explainValue(vBase), explainValue(v),
+		)
+	}
+	if !changed {
+		// The digest also covers values that are not in the build file,
+		// such as environment variables.
+		c.addf("rule changed, but not in the build file")
+	}
+}
+
+func explainStat(c *Change, cur, base *fileStat) {
+	if cur.Size != base.Size {
+		c.addf("file size: %d -> %d", base.Size, cur.Size)
+	}
+	if cur.Mode != base.Mode {
+		c.addf(
+			"file mode: %s -> %s",
+			fs.FileMode(base.Mode), fs.FileMode(cur.Mode),
+		)
+	}
+	if cur.Symlink != base.Symlink {
+		c.addf("symlink: %q -> %q", base.Symlink, cur.Symlink)
+	}
+	if cur.Sha256 != base.Sha256 {
+		c.addf("file sha256: %q -> %q", base.Sha256, cur.Sha256)
+	}
+	if cur.ModTimestamp != base.ModTimestamp {
+		c.addf(
+			"file modified: %s -> %s",
+			time.Unix(0, base.ModTimestamp).Format(time.RFC3339Nano),
+			time.Unix(0, cur.ModTimestamp).Format(time.RFC3339Nano),
+		)
+	}
+}
+
+func (x *explainer) explainDeps(c *Change, cur, base *buildAction) error {
+	var names []string
+	for dep := range cur.Deps {
+		names = append(names, dep)
+	}
+	for dep := range base.Deps {
+		if _, ok := cur.Deps[dep]; !ok {
+			names = append(names, dep)
+		}
+	}
+	sort.Strings(names)
+
+	for _, dep := range names {
+		d, ok := cur.Deps[dep]
+		dBase, okBase := base.Deps[dep]
+		if !okBase {
+			c.addf("dep added: %s", dep)
+			continue
+		}
+		if !ok {
+			c.addf("dep removed: %s", dep)
+			continue
+		}
+		if d == dBase {
+			continue
+		}
+
+		c.addf("dep changed: %s", dep)
+		depBase, err := x.findRecord(dep, dBase)
+		if err != nil {
+			return errcode.Annotatef(err, "find record of %q", dep)
+		}
+		if x.seen[dep] {
+			c.Deps = append(c.Deps, &Change{
+				Node:    dep,
+				Reasons: []string{"changed, see above"},
+			})
+			continue
+		}
+		x.seen[dep] = true
+
+		depCur := x.digester.recs[dep]
+		depChange, err := x.explain(dep, depCur, depBase)
+		if err != nil {
+			return err
+		}
+		c.Deps = append(c.Deps, depChange)
+	}
+	return nil
+}
+
+// explain explains the change of node name from record base to cur.
+func (x *explainer) explain(name string, cur, base *nodeRecord) (
+	*Change, error,
+) {
+	c := &Change{Node: name}
+	if cur == nil {
+		c.addf("always rebuilds")
+		return c, nil
+	}
+	if base == nil {
+		c.addf("no record of the previous build")
+		return c, nil
+	}
+	if cur.Digest == base.Digest {
+		c.addf("not changed")
+		return c, nil
+	}
+
+	if cur.Stat != nil && base.Stat != nil {
+		explainStat(c, cur.Stat, base.Stat)
+	}
+
+	if a, aBase := cur.Action, base.Action; a != nil && aBase != nil {
+		if a.RuleType != aBase.RuleType {
+			c.addf("rule type: %q -> %q", aBase.RuleType, a.RuleType)
+		}
+		if a.Rule != aBase.Rule {
+			explainDef(c, cur.Def, base.Def)
+		}
+		if fmt.Sprint(a.Outs) != fmt.Sprint(aBase.Outs) {
+			c.addf("outputs: %q -> %q", aBase.Outs, a.Outs)
+		}
+		if a.DockerOut != aBase.DockerOut {
+			c.addf("docker output: %t -> %t", aBase.DockerOut, a.DockerOut)
+		}
+		if err := x.explainDeps(c, a, aBase); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.Reasons) == 0 {
+		c.addf("digest changed")
+	}
+	return c, nil
+}
+
+// Explain explains why a target is rebuilt. If the target will be rebuilt
+// in the next build, it explains the changes since the last build.
+// Otherwise, it explains why the target was rebuilt in the last build.
+func (b *Builder) Explain(target string) (*Change, []*lexing.Error) {
+	targets := b.absRules([]string{target})
+	nodes, nodeMap, errs := loadNodes(b.env, targets)
+	if errs != nil {
+		return nil, errs
+	}
+	if len(nodes) != 1 {
+		err := errcode.InvalidArgf(
+			"%q matches %d targets, want exactly one", target, len(nodes),
+		)
+		return nil, lexing.SingleErr(err)
+	}
+	n := nodes[0]
+
+	cache, err := b.openCache()
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	b.setupHasher(cache)
+
+	x := &explainer{
+		cache:    cache,
+		digester: newDigester(b.env, nodeMap),
+		seen:     make(map[string]bool),
+	}
+	c, err := x.explainTarget(n)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	return c, nil
+}
+
+func (x *explainer) explainTarget(n *buildNode) (*Change, error) {
+	cur, err := x.digester.record(n)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := x.cache.getRecords(n.name)
+	if err != nil {
+		return nil, errcode.Annotate(err, "read node records")
+	}
+
+	c := &Change{Node: n.name}
+	if cur == nil {
+		c.addf("always rebuilds")
+		return c, nil
+	}
+	if recs == nil || recs.Cur == nil {
+		c.addf("never built")
+		return c, nil
+	}
+	if recs.Cur.Digest != cur.Digest {
+		return x.explain(n.name, cur, recs.Cur)
+	}
+
+	if n.typ == nodeRule {
+		built, err := x.cache.get(cur.Digest)
+		if err != nil {
+			if !errors.Is(err, errNotFoundInCache) {
+				return nil, errcode.Annotate(err, "check build cache")
+			}
+			c.addf("not in the build cache")
+			return c, nil
+		}
+		same, err := checkSameBuilt(x.digester.env, built)
+		if err != nil {
+			return nil, errcode.Annotate(err, "check built")
+		}
+		if !same {
+			c.addf("outputs changed since the last build")
+			return c, nil
+		}
+	}
+
+	if recs.Prev == nil {
+		c.addf("up to date, first build")
+		return c, nil
+	}
+	last, err := x.explain(n.name, cur, recs.Prev)
+	if err != nil {
+		return nil, err
+	}
+	last.Reasons = append(
+		[]string{"up to date, last rebuilt because:"}, last.Reasons...,
+	)
+	return last, nil
+}
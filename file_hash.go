@@ -0,0 +1,77 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"io/fs"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/hashutil"
+)
+
+// fileHashEntry is a file content hash saved in the stat cache. The hash is
+// reused as long as the file's stat stays the same.
+type fileHashEntry struct {
+	Key          string `json:"K"`
+	Size         int64  `json:"S"`
+	ModTimestamp int64  `json:"T"`
+	Mode         uint32 `json:"M"`
+	Sha256       string `json:"H"`
+}
+
+func (e *fileHashEntry) sameStat(info fs.FileInfo) bool {
+	return e.Size == info.Size() &&
+		e.ModTimestamp == info.ModTime().UnixNano() &&
+		e.Mode == uint32(info.Mode())
+}
+
+// fileHasher digests file contents with sha256, using the stat cache in the
+// build cache to skip files that are not changed.
+type fileHasher struct {
+	cache *buildCache
+}
+
+func newFileHasher(cache *buildCache) *fileHasher {
+	return &fileHasher{cache: cache}
+}
+
+// hash returns the sha256 hex digest of file f, where key is the key of the
+// file in the stat cache, and info is the current stat of the file.
+func (h *fileHasher) hash(key, f string, info fs.FileInfo) (string, error) {
+	entry, err := h.cache.getFileHash(key)
+	if err != nil {
+		return "", errcode.Annotate(err, "read stat cache")
+	}
+	if entry != nil && entry.sameStat(info) {
+		return entry.Sha256, nil
+	}
+
+	sum, err := hashutil.HashFile(f)
+	if err != nil {
+		return "", errcode.Annotate(err, "hash file")
+	}
+	entry = &fileHashEntry{
+		Key:          key,
+		Size:         info.Size(),
+		ModTimestamp: info.ModTime().UnixNano(),
+		Mode:         uint32(info.Mode()),
+		Sha256:       sum,
+	}
+	if err := h.cache.putFileHash(key, entry); err != nil {
+		return "", errcode.Annotate(err, "update stat cache")
+	}
+	return sum, nil
+}
@@ -16,8 +16,10 @@
 package caco3
 
 import (
+	"context"
 	"io/fs"
 	"log"
+	"os"
 	"path"
 	"path/filepath"
 	"sort"
@@ -70,7 +72,9 @@ type fileSet struct {
 	rule     *FileSet
 }
 
-func fileSetOut(name string) string { return name + ".fileset" }
+const fileSetExt = ".fileset"
+
+func fileSetOut(name string) string { return name + fileSetExt }
 
 func newFileSet(env *env, p string, r *FileSet) (*fileSet, error) {
 	name := makeRelPath(p, r.Name)
@@ -165,7 +169,9 @@ func newFileSet(env *env, p string, r *FileSet) (*fileSet, error) {
 }
 
 func (fs *fileSet) meta(env *env) (*buildRuleMeta, error) {
-	d, err := makeDigest(ruleFileSet, fs.name, fs.rule)
+	rule := *fs.rule
+	clearNonOutputFields(&rule)
+	d, err := makeDigest(ruleFileSet, fs.name, &rule)
 	if err != nil {
 		return nil, errcode.Annotate(err, "digest")
 	}
@@ -182,17 +188,154 @@ func (fs *fileSet) meta(env *env) (*buildRuleMeta, error) {
 	}, nil
 }
 
+// isFileSetOut checks if an output file is a file set, which lists
+// files in JSON.
+func isFileSetOut(name string) bool {
+	return strings.HasSuffix(name, fileSetExt)
+}
+
+// isFileSetInput checks if input name is a file set, which is either a
+// file set rule or a file set output.
+func isFileSetInput(env *env, name string) bool {
+	switch env.nodeType(name) {
+	case nodeRule:
+		return true
+	case nodeOut:
+		return isFileSetOut(name)
+	}
+	return false
+}
+
+// referenceFileSetOut returns the file list output of name, which is
+// either a file set rule or a file set output of a rule, like an output
+// directory of a docker_run rule.
 func referenceFileSetOut(env *env, name string) (string, error) {
-	if t := env.nodeType(name); t != nodeRule {
+	switch t := env.nodeType(name); t {
+	case nodeRule:
+		if rt := env.ruleType(name); rt != ruleFileSet {
+			return "", errcode.Internalf("not a file set, but %q", rt)
+		}
+		return fileSetOut(name), nil
+	case nodeOut:
+		if !isFileSetOut(name) {
+			return "", errcode.Internalf("%q is not a file set", name)
+		}
+		return name, nil
+	default:
 		return "", errcode.Internalf("not a file set, but %q", t)
 	}
-	if rt := env.ruleType(name); rt != ruleFileSet {
-		return "", errcode.Internalf("not a file set, but %q", rt)
+}
+
+// writeDirFileSet lists all the files in output directory dir, and saves
+// the list into file set output out.
+func writeDirFileSet(env *env, dir, out string) error {
+	var list []*fileStat
+	root := env.out(dir)
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := checkSymlink(rel, link); err != nil {
+				return err
+			}
+		}
+		name := path.Join(dir, rel)
+		stat, err := newOutFileStat(env, name)
+		if err != nil {
+			return errcode.Annotatef(err, "stat %q", name)
+		}
+		list = append(list, stat)
+		return nil
+	}
+	if err := filepath.WalkDir(root, walk); err != nil {
+		return errcode.Annotatef(err, "list files in %q", dir)
 	}
-	return fileSetOut(name), nil
+
+	f, err := env.prepareOut(out)
+	if err != nil {
+		return errcode.Annotate(err, "prepare file set output")
+	}
+	return jsonutil.WriteFile(f, list)
+}
+
+// checkSymlink checks that a symlink at name, which is a slash separated
+// path relative to a directory, links to a file inside the directory.
+func checkSymlink(name, link string) error {
+	if path.IsAbs(link) || filepath.IsAbs(link) {
+		return errcode.InvalidArgf("%q links to absolute path %q", name, link)
+	}
+	target := path.Join(path.Dir(name), filepath.ToSlash(link))
+	if !fs.ValidPath(target) {
+		return errcode.InvalidArgf(
+			"%q links to %q, outside the directory", name, link,
+		)
+	}
+	return nil
+}
+
+// inputFiles resolves a list of input files and file set rules into a map
+// from the file names to the paths on the file system.
+func inputFiles(env *env, inputs []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, in := range inputs {
+		switch typ := env.nodeType(in); typ {
+		case "":
+			return nil, errcode.Internalf("file %q not found", in)
+		case nodeSrc:
+			files[in] = env.src(in)
+		case nodeOut:
+			if !isFileSetOut(in) {
+				files[in] = env.out(in)
+				break
+			}
+			fallthrough
+		case nodeRule:
+			fileSet, err := referenceFileSetOut(env, in)
+			if err != nil {
+				return nil, errcode.Annotatef(err, "input %q", in)
+			}
+			var list []*fileStat
+			if err := jsonutil.ReadFile(env.out(fileSet), &list); err != nil {
+				return nil, errcode.Annotatef(err, "read file set %q", in)
+			}
+			for _, f := range list {
+				var fp string
+				switch f.Type {
+				case fileTypeSrc:
+					fp = env.src(f.Name)
+				case fileTypeOut:
+					fp = env.out(f.Name)
+				default:
+					return nil, errcode.Internalf(
+						"invalid file type %q of %q in set %q",
+						f.Type, f.Name, in,
+					)
+				}
+				files[f.Name] = fp
+			}
+		default:
+			return nil, errcode.Internalf("unknown type %q", typ)
+		}
+	}
+	return files, nil
 }
 
-func (fs *fileSet) build(env *env, opts *buildOpts) error {
+func (fs *fileSet) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
 	m := make(map[string]*fileStat)
 	add := func(s *fileStat) {
 		// TODO(h8liu): check if files change?
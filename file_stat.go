@@ -29,6 +29,10 @@ type fileStat struct {
 	ModTimestamp int64
 	Mode         uint32
 	Symlink      string `json:",omitempty"`
+
+	// Sha256 is the hex sha256 digest of the file content. It is only set
+	// for regular files when content hashing is enabled.
+	Sha256 string `json:",omitempty"`
 }
 
 const (
@@ -70,6 +74,15 @@ func newFileStat(env *env, p, t string) (*fileStat, error) {
 		symLink = dest
 	}
 
+	var sum string
+	if env.hasher != nil && mod.IsRegular() {
+		h, err := env.hasher.hash(t+":"+p, f, info)
+		if err != nil {
+			return nil, errcode.Annotatef(err, "hash %s:%s", t, p)
+		}
+		sum = h
+	}
+
 	return &fileStat{
 		Name:         p,
 		Type:         t,
@@ -77,6 +90,7 @@ func newFileStat(env *env, p, t string) (*fileStat, error) {
 		ModTimestamp: info.ModTime().UnixNano(),
 		Mode:         uint32(info.Mode()),
 		Symlink:      symLink,
+		Sha256:       sum,
 	}, nil
 }
 
@@ -90,7 +104,11 @@ func sameFileStat(env *env, stat *fileStat) (bool, error) {
 	}
 
 	same := cur.Size == stat.Size
-	same = same && cur.ModTimestamp == stat.ModTimestamp
+	if cur.Sha256 != "" && stat.Sha256 != "" {
+		same = same && cur.Sha256 == stat.Sha256
+	} else {
+		same = same && cur.ModTimestamp == stat.ModTimestamp
+	}
 	same = same && cur.Mode == stat.Mode
 	same = same && cur.Symlink == stat.Symlink
 
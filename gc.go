@@ -0,0 +1,358 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/jsonutil"
+	"shanhu.io/misc/strutil"
+	"shanhu.io/text/lexing"
+	"shanhu.io/virgo/dock"
+)
+
+// GCOptions contains options for garbage collecting the build cache.
+type GCOptions struct {
+	DryRun bool // Only list the garbage, do not remove anything.
+}
+
+// GCResult lists the garbage that is collected.
+type GCResult struct {
+	CacheEntries []string // Keys of expired build cache entries.
+	Outputs      []string // Output files that no rule produces.
+	Dockers      []string // Container image tags that no sum references.
+	Blobs        []string // Unreferenced blobs in the local CAS.
+
+	// Nodes whose records all have expired digests.
+	Records []string
+
+	// Stat cache keys of the content hashes of files that no longer exist.
+	FileHashes []string
+}
+
+type gcRefs struct {
+	live       map[string]bool // Digests of unexpired cache entries.
+	dockerIDs  map[string]bool
+	dockerTags map[string]bool // Candidate tags to collect.
+	blobs      map[string]bool
+}
+
+func (r *gcRefs) addDockerTag(sum *dockerSum) {
+	r.dockerTags[repoTag(sum.Repo, sum.Tag)] = true
+}
+
+func (r *gcRefs) addBuilt(b *built) {
+	for _, sum := range b.Dockers {
+		r.dockerIDs[sum.ID] = true
+		r.addDockerTag(sum)
+	}
+	for _, out := range b.Outs {
+		if out.Sha256 != "" {
+			r.blobs[out.Sha256] = true
+		}
+	}
+}
+
+func (b *Builder) gcCache(
+	cache *buildCache, refs *gcRefs, opts *GCOptions,
+) ([]string, error) {
+	var expired []string
+	if err := cache.walk(func(entry *buildCacheEntry) error {
+		if cache.expired(entry) {
+			expired = append(expired, entry.Key)
+			if entry.Built != nil {
+				for _, sum := range entry.Built.Dockers {
+					refs.addDockerTag(sum)
+				}
+			}
+		} else {
+			refs.live[entry.Key] = true
+			if entry.Built != nil {
+				refs.addBuilt(entry.Built)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errcode.Annotate(err, "walk build cache")
+	}
+	sort.Strings(expired)
+
+	if !opts.DryRun {
+		for _, k := range expired {
+			if err := cache.remove(k); err != nil {
+				return nil, errcode.Annotatef(err, "remove %q", k)
+			}
+		}
+	}
+	return expired, nil
+}
+
+func (b *Builder) gcOutputs(
+	outs map[string]bool, refs *gcRefs, opts *GCOptions,
+) ([]string, error) {
+	casDir := b.casDir()
+	npmDir := b.env.out(npmDirName)
+	execDir := b.env.out(execDirName)
+
+	var orphans []string
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// The node_modules cache is not outputs of rules; it is
+			// keyed by the digests of the lockfiles.
+			if p == casDir || p == npmDir {
+				return filepath.SkipDir
+			}
+			// Scratch dirs of exec rules are left only by failed runs.
+			if p == execDir {
+				orphans = append(orphans, execDirName)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(p); ext == restoreTempExt ||
+			ext == saveTempExt {
+			return nil // Temp file of an output being written.
+		}
+		rel, err := b.relOut(p)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(rel, "/") &&
+			strings.HasPrefix(rel, cacheFileName) {
+			return nil // Build cache file, and its journals.
+		}
+		if outs[rel] {
+			if strings.HasSuffix(rel, dockerSumExt) {
+				if sum, err := loadDockerSum(p); err == nil {
+					refs.dockerIDs[sum.ID] = true
+				}
+			}
+			return nil
+		}
+
+		orphans = append(orphans, rel)
+		if strings.HasSuffix(rel, dockerSumExt) {
+			if sum, err := loadDockerSum(p); err == nil {
+				refs.addDockerTag(sum)
+			}
+		}
+		return nil
+	}
+	if err := filepath.WalkDir(b.env.outDir, walk); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errcode.Annotate(err, "walk output dir")
+	}
+
+	if !opts.DryRun {
+		for _, orphan := range orphans {
+			if err := os.RemoveAll(b.env.out(orphan)); err != nil {
+				return nil, errcode.Annotatef(err, "remove %q", orphan)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+func (b *Builder) gcDockers(refs *gcRefs, opts *GCOptions) (
+	[]string, error,
+) {
+	ctx := context.Background()
+	var tags []string
+	for _, tag := range strutil.SortedList(refs.dockerTags) {
+		info, err := dock.InspectImage(b.env.dock, tag)
+		if err != nil {
+			if errcode.IsNotFound(err) {
+				continue
+			}
+			return nil, errcode.Annotatef(err, "inspect %q", tag)
+		}
+		if refs.dockerIDs[info.ID] {
+			continue
+		}
+		tags = append(tags, tag)
+		if opts.DryRun {
+			continue
+		}
+		if err := b.env.docker.removeImage(ctx, tag); err != nil {
+			return nil, errcode.Annotatef(err, "remove image %q", tag)
+		}
+	}
+	return tags, nil
+}
+
+func (b *Builder) gcBlobs(refs *gcRefs, opts *GCOptions) ([]string, error) {
+	var blobs []string
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if refs.blobs[name] || strings.HasPrefix(name, casTempPrefix) {
+			return nil
+		}
+		blobs = append(blobs, name)
+		if opts.DryRun {
+			return nil
+		}
+		return os.Remove(p)
+	}
+	if err := filepath.WalkDir(b.casDir(), walk); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errcode.Annotate(err, "walk local cas")
+	}
+	sort.Strings(blobs)
+	return blobs, nil
+}
+
+// gcFileHashes removes the content hashes of the files that no longer
+// exist, where orphans are the output files removed by the GC.
+func (b *Builder) gcFileHashes(
+	cache *buildCache, orphans []string, opts *GCOptions,
+) ([]string, error) {
+	removed := make(map[string]bool)
+	for _, orphan := range orphans {
+		removed[orphan] = true
+	}
+	keep := func(key string) bool {
+		t, name, ok := strings.Cut(key, ":")
+		if !ok {
+			return false
+		}
+		var f string
+		switch t {
+		case fileTypeSrc:
+			f = b.env.src(name)
+		case fileTypeOut:
+			if removed[name] {
+				return false
+			}
+			f = b.env.out(name)
+		default:
+			return false
+		}
+		_, err := os.Lstat(f)
+		return err == nil
+	}
+	return cache.pruneFileHashes(keep, opts.DryRun)
+}
+
+// GC garbage collects the build cache. It removes expired cache entries
+// and the node records of their digests, output files that are no longer
+// produced by any rule, container images tagged by the rules that are no
+// longer referenced by any docker sum, unreferenced blobs in the local
+// content-addressed store, and content hashes of files that no longer
+// exist.
+func (b *Builder) GC(opts *GCOptions) (*GCResult, []*lexing.Error) {
+	l, errs := newWorkspaceLoader(b.env)
+	if errs != nil {
+		return nil, errs
+	}
+	l.loadAll()
+	if errs := l.Errs(); errs != nil {
+		return nil, errs
+	}
+	outs := make(map[string]bool)
+	for name, n := range l.nodes {
+		if n.typ == nodeOut {
+			outs[name] = true
+		}
+		if n.typ == nodeRule && n.ruleMeta != nil {
+			// Files in output directories are listed in file sets.
+			for _, out := range n.ruleMeta.dirOuts {
+				var list []*fileStat
+				f := b.env.out(out)
+				if err := jsonutil.ReadFile(f, &list); err != nil {
+					if os.IsNotExist(err) {
+						continue
+					}
+					return nil, lexing.SingleErr(errcode.Annotatef(
+						err, "read file set %q", out,
+					))
+				}
+				for _, stat := range list {
+					outs[stat.Name] = true
+				}
+			}
+		}
+	}
+
+	cache, err := b.openCache()
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+
+	refs := &gcRefs{
+		live:       make(map[string]bool),
+		dockerIDs:  make(map[string]bool),
+		dockerTags: make(map[string]bool),
+		blobs:      make(map[string]bool),
+	}
+	res := new(GCResult)
+
+	entries, err := b.gcCache(cache, refs, opts)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.CacheEntries = entries
+
+	orphans, err := b.gcOutputs(outs, refs, opts)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.Outputs = orphans
+
+	tags, err := b.gcDockers(refs, opts)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.Dockers = tags
+
+	blobs, err := b.gcBlobs(refs, opts)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.Blobs = blobs
+
+	records, err := cache.pruneRecords(refs.live, opts.DryRun)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.Records = records
+
+	hashes, err := b.gcFileHashes(cache, orphans, opts)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	res.FileHashes = hashes
+
+	return res, nil
+}
@@ -3,6 +3,7 @@ module shanhu.io/caco3
 go 1.18
 
 require (
+	github.com/klauspost/compress v1.15.9
 	modernc.org/sqlite v1.18.0
 	shanhu.io/misc v0.0.0-20220803070526-2da1b044a170
 	shanhu.io/pisces v0.0.0-20220803070545-60830e28b0d3
@@ -0,0 +1,476 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/osutil"
+)
+
+// goModule is a Go module in the source directory, with all its files.
+type goModule struct {
+	dir   string   // Path of the module directory under src.
+	files []string // All files in the module, as source node names.
+}
+
+// newGoModule lists the files of the Go module in dir. Hidden
+// directories, directories that Go ignores, and nested modules are
+// skipped.
+func newGoModule(env *env, dir string) (*goModule, error) {
+	root := env.src(dir)
+	if ok, err := osutil.IsRegular(filepath.Join(root, "go.mod")); err != nil {
+		return nil, errcode.Annotate(err, "check go.mod")
+	} else if !ok {
+		return nil, errcode.InvalidArgf("%q is not a go module", dir)
+	}
+
+	var files []string
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p == root {
+				return nil
+			}
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			isMod, err := osutil.IsRegular(filepath.Join(p, "go.mod"))
+			if err != nil {
+				return err
+			}
+			if isMod {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".caco3") || !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(env.srcDir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	}
+	if err := filepath.WalkDir(root, walk); err != nil {
+		return nil, errcode.Annotatef(err, "list files of %q", dir)
+	}
+	return &goModule{dir: dir, files: files}, nil
+}
+
+// goToolchain runs the go command, either on the host, or in a toolchain
+// container image.
+type goToolchain struct {
+	module *goModule
+	image  string // Image rule of the toolchain; empty for using the host.
+
+	goos   string
+	goarch string
+}
+
+// goContSrcDir is where the source files are copied to in a toolchain
+// container.
+const goContSrcDir = "src"
+
+// goHostEnv is the target platform and the version of the go command on
+// the host, which is part of the digests of the rules that build with the
+// host toolchain.
+type goHostEnv struct {
+	GOOS      string
+	GOARCH    string
+	GOVERSION string
+}
+
+// goHostEnvs caches the host go environments by the GOOS and GOARCH
+// overrides, so that "go env" runs once for each target platform.
+type goHostEnvs struct {
+	mu sync.Mutex
+	m  map[string]*goHostEnv
+}
+
+func newGoHostEnvs() *goHostEnvs {
+	return &goHostEnvs{m: make(map[string]*goHostEnv)}
+}
+
+func (c *goHostEnvs) get(t *goToolchain) (*goHostEnv, error) {
+	key := t.goos + "/" + t.goarch
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.m[key]; ok {
+		return e, nil
+	}
+
+	cmd := exec.Command("go", "env", "-json", "GOOS", "GOARCH", "GOVERSION")
+	cmd.Env = os.Environ()
+	for k, v := range t.envs() {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errcode.Annotate(err, "go env")
+	}
+	e := new(goHostEnv)
+	if err := json.Unmarshal(out, e); err != nil {
+		return nil, errcode.Annotate(err, "parse go env")
+	}
+	c.m[key] = e
+	return e, nil
+}
+
+// hostEnv returns the host go environment when the toolchain runs on
+// the host. It returns nil when the toolchain is a docker image, whose ID
+// is already a dependency.
+func (t *goToolchain) hostEnv(env *env) (*goHostEnv, error) {
+	if t.image != "" {
+		return nil, nil
+	}
+	return env.goHostEnvs.get(t)
+}
+
+func (t *goToolchain) envs() map[string]string {
+	m := map[string]string{"CGO_ENABLED": "0"}
+	if t.goos != "" {
+		m["GOOS"] = t.goos
+	}
+	if t.goarch != "" {
+		m["GOARCH"] = t.goarch
+	}
+	return m
+}
+
+// runHost runs the go command with args on the host, in the module
+// directory.
+func (t *goToolchain) runHost(
+	ctx context.Context, env *env, args []string, out io.Writer,
+) error {
+	cmd := exec.CommandContext(ctx, "go", args...)
+	cmd.Dir = env.src(t.module.dir)
+	cmd.Env = os.Environ()
+	for k, v := range t.envs() {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// runCont runs shell script in the toolchain container, in the module
+// directory, and copies out the outputs.
+func (t *goToolchain) runCont(
+	ctx context.Context, env *env, opts *buildOpts,
+	script string, outMap map[string]string,
+) error {
+	img, err := env.nameToRepoTag(t.image)
+	if err != nil {
+		return errcode.Annotate(err, "map toolchain image name")
+	}
+	ts, err := srcTarStream(env, t.module.files, goContSrcDir)
+	if err != nil {
+		return errcode.Annotate(err, "make source tarball")
+	}
+
+	var outs []string
+	for out := range outMap {
+		outs = append(outs, out)
+	}
+	job := &contRun{
+		image: img,
+		config: &contConfig{
+			cmd:     []string{"sh", "-c", script},
+			workDir: path.Join("/", goContSrcDir, t.module.dir),
+			env:     t.envs(),
+		},
+		input:  ts,
+		outs:   outs,
+		outMap: outMap,
+	}
+	return job.run(ctx, env, opts)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellCommand(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+func goBuildFlags(tags []string, ldflags string) []string {
+	flags := []string{"-trimpath"}
+	if len(tags) > 0 {
+		flags = append(flags, "-tags", strings.Join(tags, ","))
+	}
+	if ldflags != "" {
+		flags = append(flags, "-ldflags", ldflags)
+	}
+	return flags
+}
+
+// newGoRule parses the common fields of Go rules.
+func newGoRule(env *env, p, module, toolchain, timeout string) (
+	*goToolchain, []string, time.Duration, error,
+) {
+	t, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	mod, err := newGoModule(env, makePath(p, module))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	tc := &goToolchain{module: mod}
+	deps := append([]string(nil), mod.files...)
+	if toolchain != "" {
+		tc.image = makePath(p, toolchain)
+		deps = append(deps, dockerSumOut(tc.image))
+	}
+	return tc, deps, t, nil
+}
+
+type goBinary struct {
+	name      string
+	rule      *GoBinary
+	toolchain *goToolchain
+	deps      []string
+	out       string
+	timeout   time.Duration
+}
+
+func newGoBinary(env *env, p string, r *GoBinary) (*goBinary, error) {
+	if r.Output == "" {
+		return nil, errcode.InvalidArgf("output not specified")
+	}
+	tc, deps, timeout, err := newGoRule(
+		env, p, r.Module, r.Toolchain, r.Timeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tc.goos = r.GOOS
+	tc.goarch = r.GOARCH
+
+	return &goBinary{
+		name:      makeRelPath(p, r.Name),
+		rule:      r,
+		toolchain: tc,
+		deps:      deps,
+		out:       makeRelPath(p, r.Output),
+		timeout:   timeout,
+	}, nil
+}
+
+func (b *goBinary) meta(env *env) (*buildRuleMeta, error) {
+	rule := *b.rule
+	clearNonOutputFields(&rule)
+
+	host, err := b.toolchain.hostEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	dat := struct {
+		Rule *GoBinary
+		Host *goHostEnv `json:",omitempty"`
+	}{
+		Rule: &rule,
+		Host: host,
+	}
+	digest, err := makeDigest(ruleGoBinary, b.name, &dat)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+	return &buildRuleMeta{
+		name:   b.name,
+		deps:   b.deps,
+		outs:   []string{b.out},
+		digest: digest,
+	}, nil
+}
+
+func (b *goBinary) args(out string) []string {
+	pkg := b.rule.Package
+	if pkg == "" {
+		pkg = "."
+	}
+	args := []string{"build"}
+	args = append(args, goBuildFlags(b.rule.Tags, b.rule.Ldflags)...)
+	args = append(args, "-o", out, pkg)
+	return args
+}
+
+func (b *goBinary) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, b.timeout, func(ctx context.Context) error {
+		return b.run(ctx, env, opts)
+	})
+}
+
+func (b *goBinary) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	tc := b.toolchain
+	if tc.image != "" {
+		const contOut = "/tmp/caco3-go-binary"
+		script := shellCommand(append([]string{"go"}, b.args(contOut)...))
+		return tc.runCont(
+			ctx, env, opts, script, map[string]string{b.out: contOut},
+		)
+	}
+
+	out, err := env.prepareOut(b.out)
+	if err != nil {
+		return errcode.Annotate(err, "prepare output")
+	}
+	if err := tc.runHost(ctx, env, b.args(out), opts.log); err != nil {
+		return errcode.Annotate(err, "go build")
+	}
+	return nil
+}
+
+func goTestOut(name string) string { return name + ".testlog" }
+
+type goTest struct {
+	name      string
+	rule      *GoTest
+	toolchain *goToolchain
+	deps      []string
+	out       string
+	timeout   time.Duration
+}
+
+func newGoTest(env *env, p string, r *GoTest) (*goTest, error) {
+	tc, deps, timeout, err := newGoRule(
+		env, p, r.Module, r.Toolchain, r.Timeout,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tc.goos = r.GOOS
+	tc.goarch = r.GOARCH
+
+	name := makeRelPath(p, r.Name)
+	return &goTest{
+		name:      name,
+		rule:      r,
+		toolchain: tc,
+		deps:      deps,
+		out:       goTestOut(name),
+		timeout:   timeout,
+	}, nil
+}
+
+func (t *goTest) meta(env *env) (*buildRuleMeta, error) {
+	rule := *t.rule
+	clearNonOutputFields(&rule)
+
+	host, err := t.toolchain.hostEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	dat := struct {
+		Rule *GoTest
+		Host *goHostEnv `json:",omitempty"`
+	}{
+		Rule: &rule,
+		Host: host,
+	}
+	digest, err := makeDigest(ruleGoTest, t.name, &dat)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+	return &buildRuleMeta{
+		name:   t.name,
+		deps:   t.deps,
+		outs:   []string{t.out},
+		digest: digest,
+	}, nil
+}
+
+func (t *goTest) args() []string {
+	pkgs := t.rule.Packages
+	if len(pkgs) == 0 {
+		pkgs = []string{"./..."}
+	}
+	args := []string{"test"}
+	args = append(args, goBuildFlags(t.rule.Tags, t.rule.Ldflags)...)
+	args = append(args, pkgs...)
+	return args
+}
+
+func (t *goTest) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, t.timeout, func(ctx context.Context) error {
+		return t.run(ctx, env, opts)
+	})
+}
+
+func (t *goTest) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	tc := t.toolchain
+	if tc.image != "" {
+		const contOut = "/tmp/caco3-go-test.log"
+		script := fmt.Sprintf(
+			"%s > %s 2>&1; s=$?; cat %s; exit $s",
+			shellCommand(append([]string{"go"}, t.args()...)),
+			contOut, contOut,
+		)
+		return tc.runCont(
+			ctx, env, opts, script, map[string]string{t.out: contOut},
+		)
+	}
+
+	out, err := env.prepareOut(t.out)
+	if err != nil {
+		return errcode.Annotate(err, "prepare output")
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return errcode.Annotate(err, "create test log")
+	}
+	defer f.Close()
+
+	w := io.MultiWriter(f, opts.log)
+	if err := tc.runHost(ctx, env, t.args(), w); err != nil {
+		return errcode.Annotate(err, "go test")
+	}
+	return f.Close()
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"sort"
+	"strings"
+
+	"shanhu.io/text/lexing"
+)
+
+// GraphNode is a node in the build graph.
+type GraphNode struct {
+	Name     string
+	Type     string   // "rule", "src" or "out".
+	RuleType string   `json:",omitempty"`
+	Deps     []string `json:",omitempty"`
+	Outs     []string `json:",omitempty"` // Outputs of a rule.
+
+	// Where the rule is declared in its build file, or where the output
+	// is declared.
+	Pos string `json:",omitempty"`
+}
+
+// NodeKind is the kind of a graph node, which tells how to present it.
+type NodeKind string
+
+// Kinds of graph nodes.
+const (
+	NodeSrc        NodeKind = "src"         // Source file.
+	NodeRule       NodeKind = "rule"        // Rule of other types.
+	NodeFileSet    NodeKind = "file_set"    // File set rule.
+	NodeBundle     NodeKind = "bundle"      // Bundle rule.
+	NodeOut        NodeKind = "out"         // Output of other kinds.
+	NodeDockerSum  NodeKind = "docker_sum"  // Docker image sum output.
+	NodeFileSetOut NodeKind = "fileset_out" // File set output.
+)
+
+// Kind returns the kind of the node.
+func (n *GraphNode) Kind() NodeKind {
+	switch n.Type {
+	case nodeSrc:
+		return NodeSrc
+	case nodeRule:
+		switch n.RuleType {
+		case ruleFileSet:
+			return NodeFileSet
+		case ruleBundle:
+			return NodeBundle
+		}
+		return NodeRule
+	case nodeOut:
+		switch {
+		case strings.HasSuffix(n.Name, dockerSumExt):
+			return NodeDockerSum
+		case isFileSetOut(n.Name):
+			return NodeFileSetOut
+		}
+		return NodeOut
+	}
+	return NodeKind(n.Type)
+}
+
+func newGraphNode(n *buildNode) *GraphNode {
+	g := &GraphNode{
+		Name:     n.name,
+		Type:     n.typ,
+		RuleType: n.ruleType,
+		Deps:     n.deps,
+	}
+	if n.ruleMeta != nil {
+		g.Outs = n.ruleMeta.outs
+	}
+	if n.pos != nil {
+		g.Pos = n.pos.String()
+	}
+	return g
+}
+
+// graphNodes converts a set of nodes into graph nodes, sorted by name.
+func graphNodes(nodes map[string]*buildNode, set nodeSet) []*GraphNode {
+	var ret []*GraphNode
+	for _, name := range set.list() {
+		ret = append(ret, newGraphNode(nodes[name]))
+	}
+	return ret
+}
+
+// nodeSet is a set of node names.
+type nodeSet map[string]bool
+
+func (s nodeSet) list() []string {
+	var names []string
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Graph returns the nodes of the given targets and all their
+// dependencies, sorted by name.
+func (b *Builder) Graph(targets []string) ([]*GraphNode, []*lexing.Error) {
+	_, nodes, errs := loadNodes(b.env, b.absRules(targets))
+	if errs != nil {
+		return nil, errs
+	}
+	set := make(nodeSet)
+	for name := range nodes {
+		set[name] = true
+	}
+	return graphNodes(nodes, set), nil
+}
+
+// loadGraph loads all the nodes in the workspace, with all their
+// dependencies.
+func loadGraph(env *env) (*loader, []*lexing.Error) {
+	l, errs := newWorkspaceLoader(env)
+	if errs != nil {
+		return nil, errs
+	}
+	l.loadAll()
+
+	var names []string
+	for name := range l.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	l.load(names, nil)
+	if errs := l.Errs(); errs != nil {
+		return nil, errs
+	}
+	return l, nil
+}
@@ -18,7 +18,10 @@ package caco3
 import (
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
+	"strings"
 
 	"shanhu.io/misc/errcode"
 	"shanhu.io/text/lexing"
@@ -34,6 +37,15 @@ type loader struct {
 	// loaded.
 	loaded map[string]*buildNode
 
+	// Packages, which are directories under src, that are already
+	// checked for build files.
+	packages map[string]bool
+
+	// Output directories of rules, mapped to the rules. Output
+	// directories are replaced as a whole when built, so no other output
+	// can be in an output directory.
+	outDirs map[string]*buildNode
+
 	tracer *loadTracer
 
 	errList *lexing.ErrorList
@@ -41,11 +53,13 @@ type loader struct {
 
 func newLoader(env *env) *loader {
 	return &loader{
-		env:     env,
-		loaded:  make(map[string]*buildNode),
-		nodes:   make(map[string]*buildNode),
-		tracer:  newLoadTracer(),
-		errList: lexing.NewErrorList(),
+		env:      env,
+		loaded:   make(map[string]*buildNode),
+		nodes:    make(map[string]*buildNode),
+		packages: make(map[string]bool),
+		outDirs:  make(map[string]*buildNode),
+		tracer:   newLoadTracer(),
+		errList:  lexing.NewErrorList(),
 	}
 }
 
@@ -87,10 +101,14 @@ func (l *loader) load1(name string, pos *lexing.Pos) *buildNode {
 		return n // already loaded
 	}
 
+	l.loadAncestors(name)
 	n, ok := l.nodes[name]
 	if ok { // Registered but not loaded yet
-		l.load(n.deps, pos) // Load its dependencies.
-		l.loaded[name] = n  // Add into loaded map.
+		deps := l.load(n.deps, pos) // Load its dependencies.
+		if n.typ == nodeRule {
+			l.checkDepsVisible(n, deps)
+		}
+		l.loaded[name] = n // Add into loaded map.
 		return n
 	}
 
@@ -117,22 +135,82 @@ func (l *loader) load1(name string, pos *lexing.Pos) *buildNode {
 	return nil
 }
 
-func (l *loader) registerOuts(
-	rule string, names []string, pos *lexing.Pos,
-) {
+func (l *loader) registerOuts(rule *buildNode, names []string) {
 	if len(names) == 0 {
 		return
 	}
 
-	deps := []string{rule}
+	deps := []string{rule.name}
 	for _, name := range names {
 		n := &buildNode{
-			name: name,
-			typ:  nodeOut,
-			deps: deps,
-			pos:  pos,
+			name:       name,
+			typ:        nodeOut,
+			deps:       deps,
+			pos:        rule.pos,
+			pkg:        rule.pkg,
+			visibility: rule.visibility,
 		}
 		l.register(n)
+		if dir, r := l.findOutDir(path.Dir(name)); r != nil {
+			l.outDirOverlaps(rule, name, dir, r)
+		}
+	}
+}
+
+// findOutDir finds the output directory that is p or a parent of p.
+func (l *loader) findOutDir(p string) (string, *buildNode) {
+	for ; p != "."; p = path.Dir(p) {
+		if r, ok := l.outDirs[p]; ok {
+			return p, r
+		}
+	}
+	return "", nil
+}
+
+func (l *loader) outDirOverlaps(
+	rule *buildNode, out, dir string, r *buildNode,
+) {
+	l.errList.Errorf(
+		rule.pos, "output %q overlaps with output dir %q of %q",
+		out, dir, r.name,
+	)
+	if r != rule && r.pos != nil {
+		l.errList.Errorf(r.pos, "  previously defined here")
+	}
+}
+
+// registerOutDirs registers the output directories of a rule, which are
+// listed by the file set outputs in dirOuts. Output directories cannot
+// overlap with other outputs or output directories.
+func (l *loader) registerOutDirs(rule *buildNode, dirOuts []string) {
+	for _, out := range dirOuts {
+		dir := strings.TrimSuffix(out, fileSetExt)
+		if d, r := l.findOutDir(dir); r != nil {
+			l.outDirOverlaps(rule, dir, d, r)
+			continue
+		}
+
+		prefix := dir + "/"
+		var overlaps []string
+		for name, n := range l.nodes {
+			if n.typ == nodeOut &&
+				(name == dir || strings.HasPrefix(name, prefix)) {
+				overlaps = append(overlaps, name)
+			}
+		}
+		for d := range l.outDirs {
+			if strings.HasPrefix(d, prefix) {
+				overlaps = append(overlaps, d)
+			}
+		}
+		if len(overlaps) > 0 {
+			sort.Strings(overlaps)
+			l.errList.Errorf(
+				rule.pos, "output dir %q overlaps with %q", dir, overlaps,
+			)
+			continue
+		}
+		l.outDirs[dir] = rule
 	}
 }
 
@@ -143,38 +221,111 @@ func (l *loader) readBuildFile(p string) {
 		l.register(n)
 
 		if n.typ == nodeRule {
-			l.registerOuts(n.name, n.ruleMeta.outs, n.pos)
+			l.registerOuts(n, n.ruleMeta.outs)
+			l.registerOutDirs(n, n.ruleMeta.dirOuts)
 		}
 	}
 }
 
-func (l *loader) Errs() []*lexing.Error {
-	return l.errList.Errs()
+// loadPackage reads and registers the build file in directory p, if the
+// package is not checked yet.
+func (l *loader) loadPackage(p string) {
+	if l.packages[p] {
+		return
+	}
+	l.packages[p] = true
+	l.readBuildFile(p)
 }
 
-func loadNodes(env *env, names []string) (
-	[]*buildNode, map[string]*buildNode, []*lexing.Error,
-) {
-	l := newLoader(env)
+// loadAncestors loads all the packages that can declare node name, which
+// are the parent directories of name.
+func (l *loader) loadAncestors(name string) {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		l.loadPackage(strings.Join(parts[:i], "/"))
+	}
+}
 
-	repoMap := env.workspace.RepoMap
-	if repoMap == nil || len(repoMap.Src) == 0 {
-		err := errcode.InvalidArgf("repo map missing")
-		return nil, nil, lexing.SingleErr(err)
+// loadPackagesUnder loads all the packages under directory p, including
+// p itself. Hidden directories are skipped.
+func (l *loader) loadPackagesUnder(p string) {
+	l.loadAncestors(p)
+
+	root := l.env.src(p)
+	err := filepath.WalkDir(root, func(
+		f string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			if f == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if f != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(l.env.srcDir, f)
+		if err != nil {
+			return err
+		}
+		l.loadPackage(filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		l.errList.Add(&lexing.Error{
+			Err: errcode.Annotatef(err, "load packages under %q", p),
+		})
 	}
+}
+
+// loadAll loads all the packages in all the repos of the workspace.
+func (l *loader) loadAll() {
 	var dirs []string
-	for dir := range repoMap.Src {
+	for dir := range l.env.workspace.RepoMap.Src {
 		dirs = append(dirs, dir)
 	}
 	sort.Strings(dirs)
 
 	for _, dir := range dirs {
-		l.readBuildFile(dir)
+		l.loadPackagesUnder(dir)
 	}
+}
 
+func (l *loader) Errs() []*lexing.Error {
+	return l.errList.Errs()
+}
+
+// newWorkspaceLoader creates a loader for the repos in the workspace.
+// Build files are read when the nodes or the patterns that point into
+// their packages are loaded.
+func newWorkspaceLoader(env *env) (*loader, []*lexing.Error) {
+	repoMap := env.workspace.RepoMap
+	if repoMap == nil || len(repoMap.Src) == 0 {
+		err := errcode.InvalidArgf("repo map missing")
+		return nil, lexing.SingleErr(err)
+	}
+	return newLoader(env), nil
+}
+
+// loadNodes loads the nodes matched by the target patterns.
+func loadNodes(env *env, patterns []string) (
+	[]*buildNode, map[string]*buildNode, []*lexing.Error,
+) {
+	l, errs := newWorkspaceLoader(env)
+	if errs != nil {
+		return nil, nil, errs
+	}
+
+	names, err := expandPatterns(l, patterns)
 	if errs := l.Errs(); errs != nil {
 		return nil, nil, errs
 	}
+	if err != nil {
+		return nil, nil, lexing.SingleErr(err)
+	}
 
 	nodes := l.load(names, nil)
 	if errs := l.Errs(); errs != nil {
@@ -0,0 +1,105 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"testing"
+)
+
+func TestLoaderOutDirs(t *testing.T) {
+	type rule struct {
+		name    string
+		outs    []string
+		outDirs []string
+	}
+	testRule := func(r *rule) *buildNode {
+		meta := &buildRuleMeta{name: r.name, outs: r.outs}
+		for _, d := range r.outDirs {
+			out := fileSetOut(d)
+			meta.outs = append(meta.outs, out)
+			meta.dirOuts = append(meta.dirOuts, out)
+		}
+		return &buildNode{name: r.name, typ: nodeRule, ruleMeta: meta}
+	}
+
+	for _, test := range []struct {
+		desc    string
+		rules   []*rule
+		invalid bool
+	}{{
+		desc: "separate dirs",
+		rules: []*rule{
+			{name: "p/a", outs: []string{"p/a.txt"}, outDirs: []string{"p/a"}},
+			{name: "p/b", outDirs: []string{"p/dist", "p/distx"}},
+		},
+	}, {
+		desc: "output in dir of another rule",
+		rules: []*rule{
+			{name: "p/a", outDirs: []string{"p/dist"}},
+			{name: "p/b", outs: []string{"p/dist/b.txt"}},
+		},
+		invalid: true,
+	}, {
+		desc: "dir over output of another rule",
+		rules: []*rule{
+			{name: "p/b", outs: []string{"p/dist/sub/b.txt"}},
+			{name: "p/a", outDirs: []string{"p/dist"}},
+		},
+		invalid: true,
+	}, {
+		desc: "output in dir of the same rule",
+		rules: []*rule{{
+			name:    "p/a",
+			outs:    []string{"p/dist/a.txt"},
+			outDirs: []string{"p/dist"},
+		}},
+		invalid: true,
+	}, {
+		desc: "dir as an output",
+		rules: []*rule{
+			{name: "p/a", outs: []string{"p/dist"}},
+			{name: "p/b", outDirs: []string{"p/dist"}},
+		},
+		invalid: true,
+	}, {
+		desc: "nested dirs",
+		rules: []*rule{
+			{name: "p/a", outDirs: []string{"p/dist/sub"}},
+			{name: "p/b", outDirs: []string{"p/dist"}},
+		},
+		invalid: true,
+	}, {
+		desc: "nested dirs in the same rule",
+		rules: []*rule{
+			{name: "p/a", outDirs: []string{"p/dist", "p/dist/sub"}},
+		},
+		invalid: true,
+	}} {
+		l := newLoader(&env{})
+		for _, r := range test.rules {
+			n := testRule(r)
+			l.register(n)
+			l.registerOuts(n, n.ruleMeta.outs)
+			l.registerOutDirs(n, n.ruleMeta.dirOuts)
+		}
+		errs := l.Errs()
+		if test.invalid && errs == nil {
+			t.Errorf("%s: got no error", test.desc)
+		} else if !test.invalid && errs != nil {
+			t.Errorf("%s: got errors: %v", test.desc, errs)
+		}
+	}
+}
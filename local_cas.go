@@ -0,0 +1,149 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/osutil"
+)
+
+// casDirName is the default name of the local content-addressed store
+// directory in the output directory.
+const casDirName = "CAS"
+
+// casTempPrefix is the name prefix of the temp files of blobs being saved.
+const casTempPrefix = "tmp-"
+
+// localCAS is a local content-addressed store that keeps a copy of every
+// output file produced, keyed by the sha256 of the content.
+//
+// Files are copied in and out rather than hard linked, because rules
+// often write their outputs in place, which would also change the copy in
+// the store.
+type localCAS struct {
+	dir string
+}
+
+func newLocalCAS(dir string) *localCAS {
+	return &localCAS{dir: dir}
+}
+
+func (c *localCAS) file(sum string) string {
+	return filepath.Join(c.dir, sum[:2], sum)
+}
+
+func (c *localCAS) putFile(f, sum string) error {
+	p := c.file(sum)
+	if ok, err := osutil.Exist(p); err != nil {
+		return err
+	} else if ok {
+		return nil
+	}
+
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errcode.Annotate(err, "make dir")
+	}
+
+	r, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp(dir, casTempPrefix+"*")
+	if err != nil {
+		return errcode.Annotate(err, "create temp file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return errcode.Annotate(err, "copy")
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// put saves all the output files of b into the store.
+func (c *localCAS) put(env *env, b *built) error {
+	for _, out := range b.Outs {
+		if out.Symlink != "" || out.Sha256 == "" {
+			continue
+		}
+		if err := c.putFile(env.out(out.Name), out.Sha256); err != nil {
+			return errcode.Annotatef(err, "save %q", out.Name)
+		}
+	}
+	return nil
+}
+
+// hasAll checks if all the output files of b are in the store.
+func (c *localCAS) hasAll(b *built) (bool, error) {
+	if !restorable(b) {
+		return false, nil
+	}
+	for _, out := range b.Outs {
+		if out.Symlink != "" {
+			continue
+		}
+		if ok, err := osutil.Exist(c.file(out.Sha256)); err != nil {
+			return false, err
+		} else if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// restore restores all the output files of b from the store, where meta
+// is the rule that builds b. It returns false if any of the output files
+// is missing in the store.
+func (c *localCAS) restore(
+	env *env, meta *buildRuleMeta, b *built,
+) (bool, error) {
+	if err := checkRestoreOuts(meta, b); err != nil {
+		return false, err
+	}
+	if ok, err := c.hasAll(b); err != nil {
+		return false, err
+	} else if !ok {
+		return false, nil
+	}
+
+	for _, out := range b.Outs {
+		same, err := sameFileStat(env, out)
+		if err != nil {
+			return false, errcode.Annotatef(err, "check %q", out.Name)
+		}
+		if same {
+			continue
+		}
+		open := func() (io.ReadCloser, error) {
+			return os.Open(c.file(out.Sha256))
+		}
+		if err := restoreOut(env, out, open); err != nil {
+			return false, errcode.Annotatef(err, "restore %q", out.Name)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/hashutil"
+	"shanhu.io/misc/osutil"
+	"shanhu.io/misc/tarutil"
+)
+
+// npmDirName is the name of the directory in the output directory that
+// caches node_modules tarballs, keyed by the digests of the lockfiles.
+const npmDirName = "_npm"
+
+// Where files are placed in the node container.
+const (
+	npmContSrcDir  = "src"
+	npmContWorkDir = "/tmp/caco3-npm"
+	npmContModules = npmContWorkDir + "/node_modules.tar"
+	npmContOut     = npmContWorkDir + "/out.tar"
+)
+
+func npmOut(name string) string { return name + ".tar" }
+
+type npmBuild struct {
+	name     string
+	rule     *NpmBuild
+	dir      string // Package directory under src.
+	lockfile string
+	files    []string
+	image    string
+	envs     map[string]string
+	out      string
+	timeout  time.Duration
+}
+
+// listNpmFiles lists the source files of the npm package in dir. Hidden
+// directories, node_modules and the output directory are skipped.
+func listNpmFiles(env *env, dir, outDir string) ([]string, error) {
+	root := env.src(dir)
+	var files []string
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(env.srcDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		name := d.Name()
+		if d.IsDir() {
+			if p == root {
+				return nil
+			}
+			if strings.HasPrefix(name, ".") || name == "node_modules" ||
+				rel == outDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".caco3") || !d.Type().IsRegular() {
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	}
+	if err := filepath.WalkDir(root, walk); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func newNpmBuild(env *env, p string, r *NpmBuild) (*npmBuild, error) {
+	if r.Script == "" {
+		return nil, errcode.InvalidArgf("script not specified")
+	}
+	if r.Image == "" {
+		return nil, errcode.InvalidArgf("image not specified")
+	}
+	if r.OutputDir == "" {
+		return nil, errcode.InvalidArgf("output dir not specified")
+	}
+	timeout, err := parseTimeout(r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := makePath(p, r.Dir)
+	lockfile := r.Lockfile
+	if lockfile == "" {
+		lockfile = "package-lock.json"
+	}
+	lockfile = makeRelPath(dir, lockfile)
+	if ok, err := osutil.IsRegular(env.src(lockfile)); err != nil {
+		return nil, errcode.Annotate(err, "check lockfile")
+	} else if !ok {
+		return nil, errcode.InvalidArgf("lockfile %q not found", lockfile)
+	}
+
+	files, err := listNpmFiles(env, dir, makeRelPath(dir, r.OutputDir))
+	if err != nil {
+		return nil, errcode.Annotatef(err, "list files of %q", dir)
+	}
+
+	name := makeRelPath(p, r.Name)
+	return &npmBuild{
+		name:     name,
+		rule:     r,
+		dir:      dir,
+		lockfile: lockfile,
+		files:    files,
+		image:    makePath(p, r.Image),
+		envs:     makeDockerVars(r.Envs),
+		out:      npmOut(name),
+		timeout:  timeout,
+	}, nil
+}
+
+func (b *npmBuild) meta(env *env) (*buildRuleMeta, error) {
+	rule := *b.rule
+	clearNonOutputFields(&rule)
+
+	dat := struct {
+		Rule *NpmBuild
+		Envs map[string]string `json:",omitempty"`
+	}{
+		Rule: &rule,
+		Envs: b.envs,
+	}
+	digest, err := makeDigest(ruleNpmBuild, b.name, &dat)
+	if err != nil {
+		return nil, errcode.Annotate(err, "digest")
+	}
+
+	var deps []string
+	deps = append(deps, dockerSumOut(b.image))
+	deps = append(deps, b.files...)
+	return &buildRuleMeta{
+		name:   b.name,
+		deps:   deps,
+		outs:   []string{b.out},
+		digest: digest,
+	}, nil
+}
+
+// modulesKey returns the cache key of node_modules, which is the digest of
+// the lockfile, package.json and the node image.
+func (b *npmBuild) modulesKey(env *env, imageID string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintln(h, imageID)
+	for _, f := range []string{
+		b.lockfile, path.Join(b.dir, "package.json"),
+	} {
+		sum, err := hashFileIfExist(env.src(f))
+		if err != nil {
+			return "", errcode.Annotatef(err, "hash %q", f)
+		}
+		fmt.Fprintln(h, f, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFileIfExist(f string) (string, error) {
+	if ok, err := osutil.Exist(f); err != nil {
+		return "", err
+	} else if !ok {
+		return "", nil
+	}
+	return hashutil.HashFile(f)
+}
+
+func (b *npmBuild) build(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	return runWithTimeout(ctx, b.timeout, func(ctx context.Context) error {
+		return b.run(ctx, env, opts)
+	})
+}
+
+func (b *npmBuild) run(
+	ctx context.Context, env *env, opts *buildOpts,
+) error {
+	sum, err := loadDockerSum(env.out(dockerSumOut(b.image)))
+	if err != nil {
+		return errcode.Annotate(err, "load node image sum")
+	}
+	key, err := b.modulesKey(env, sum.ID)
+	if err != nil {
+		return errcode.Annotate(err, "digest node_modules")
+	}
+	modulesCache := path.Join(npmDirName, key+".tar")
+	cached, err := osutil.Exist(env.out(modulesCache))
+	if err != nil {
+		return errcode.Annotate(err, "check node_modules cache")
+	}
+
+	img, err := env.nameToRepoTag(b.image)
+	if err != nil {
+		return errcode.Annotate(err, "map image name")
+	}
+	ts, err := srcTarStream(env, b.files, npmContSrcDir)
+	if err != nil {
+		return errcode.Annotate(err, "make source tarball")
+	}
+
+	outDir := makeRelPath("", b.rule.OutputDir)
+	outs := []string{b.out}
+	outMap := map[string]string{b.out: npmContOut}
+	var installModules string
+	var modulesTemp string
+	if cached {
+		ts.AddFile(
+			strings.TrimPrefix(npmContModules, "/"), new(tarutil.Meta),
+			env.out(modulesCache),
+		)
+		installModules = fmt.Sprintf("tar -xf %s", npmContModules)
+	} else {
+		installModules = fmt.Sprintf(
+			"npm ci && tar -cf %s node_modules", npmContModules,
+		)
+
+		// The tarball is copied out to a temp file first, and only
+		// renamed into the cache after the build succeeds, so that the
+		// cache never has partial tarballs, even when rules with the
+		// same key build in parallel.
+		temp, err := npmTempFile(env)
+		if err != nil {
+			return errcode.Annotate(err, "create node_modules temp file")
+		}
+		defer os.Remove(env.out(temp))
+		modulesTemp = temp
+		outs = append(outs, modulesTemp)
+		outMap[modulesTemp] = npmContModules
+	}
+
+	script := strings.Join([]string{
+		"set -e",
+		"mkdir -p " + npmContWorkDir,
+		installModules,
+		"npm run " + shellQuote(b.rule.Script),
+		fmt.Sprintf("tar -cf %s -C %s .", npmContOut, shellQuote(outDir)),
+	}, "\n")
+
+	job := &contRun{
+		image: img,
+		config: &contConfig{
+			cmd:     []string{"sh", "-c", script},
+			workDir: path.Join("/", npmContSrcDir, b.dir),
+			env:     b.envs,
+		},
+		input:  ts,
+		outs:   outs,
+		outMap: outMap,
+	}
+	if err := job.run(ctx, env, opts); err != nil {
+		return err
+	}
+	if modulesTemp != "" {
+		from := env.out(modulesTemp)
+		if err := os.Rename(from, env.out(modulesCache)); err != nil {
+			return errcode.Annotate(err, "save node_modules cache")
+		}
+	}
+	return nil
+}
+
+// npmTempFile creates an empty temp file in the node_modules cache
+// directory, and returns its output path.
+func npmTempFile(env *env) (string, error) {
+	dir := env.out(npmDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(f.Name())
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path.Join(npmDirName, name), nil
+}
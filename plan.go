@@ -0,0 +1,164 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"errors"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+// PlanStep is a rule that would execute in a build.
+type PlanStep struct {
+	Rule     string
+	RuleType string
+	Reason   string // Why the rule would execute.
+
+	// Outputs would be restored from the local content-addressed store,
+	// rather than rebuilt.
+	Restore bool `json:",omitempty"`
+}
+
+type planner struct {
+	env      *env
+	opts     *buildOpts
+	cache    *buildCache
+	cas      *localCAS
+	digester *digester
+
+	visited map[string]bool
+	steps   []*PlanStep
+}
+
+// reason returns why n would execute, or empty string if n is a cache hit.
+func (p *planner) reason(n *buildNode, rec *nodeRecord) (
+	string, *built, error,
+) {
+	if rec == nil {
+		return "always rebuilds", nil, nil
+	}
+	if p.opts.alwaysRebuild {
+		return "rebuild forced", nil, nil
+	}
+	b, err := p.cache.get(rec.Digest)
+	if err != nil {
+		if errors.Is(err, errNotFoundInCache) {
+			return "not in the build cache", nil, nil
+		}
+		return "", nil, errcode.Annotate(err, "check build cache")
+	}
+	same, err := checkSameBuilt(p.env, b)
+	if err != nil {
+		return "", nil, errcode.Annotate(err, "check built")
+	}
+	if !same {
+		return "outputs changed", b, nil
+	}
+	return "", nil, nil
+}
+
+// canRestore checks if all the outputs in b can be restored from the local
+// content-addressed store.
+func (p *planner) canRestore(b *built) (bool, error) {
+	if p.cas == nil || len(b.Dockers) > 0 || !restorable(b) {
+		return false, nil
+	}
+	return p.cas.hasAll(b)
+}
+
+func (p *planner) plan(n *buildNode) error {
+	if p.visited[n.name] {
+		return nil
+	}
+	p.visited[n.name] = true
+
+	for _, dep := range n.deps {
+		depNode := p.digester.nodes[dep]
+		if depNode == nil {
+			return errcode.InvalidArgf(
+				"dep %q for %q not found", dep, n.name,
+			)
+		}
+		if err := p.plan(depNode); err != nil {
+			return err
+		}
+	}
+
+	if n.typ != nodeRule || n.rule == nil {
+		return nil
+	}
+
+	rec, err := p.digester.record(n)
+	if err != nil {
+		return err
+	}
+	reason, cached, err := p.reason(n, rec)
+	if err != nil {
+		return errcode.Annotatef(err, "plan %q", n.name)
+	}
+	if reason == "" {
+		return nil
+	}
+
+	step := &PlanStep{
+		Rule:     n.name,
+		RuleType: n.ruleType,
+		Reason:   reason,
+	}
+	if cached != nil {
+		restore, err := p.canRestore(cached)
+		if err != nil {
+			return errcode.Annotatef(err, "check local cas for %q", n.name)
+		}
+		step.Restore = restore
+	}
+	p.steps = append(p.steps, step)
+	return nil
+}
+
+// Plan returns the rules that would execute when building the given rules,
+// in an order that they can execute one by one. It does not execute any
+// rule.
+func (b *Builder) Plan(rules []string) ([]*PlanStep, []*lexing.Error) {
+	nodes, nodeMap, errs := loadNodes(b.env, b.absRules(rules))
+	if errs != nil {
+		return nil, errs
+	}
+	cache, err := b.openCache()
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	b.setupHasher(cache)
+
+	p := &planner{
+		env:      b.env,
+		opts:     b.opts,
+		cache:    cache,
+		digester: newDigester(b.env, nodeMap),
+		visited:  make(map[string]bool),
+	}
+	if b.opts.localCAS {
+		p.cas = newLocalCAS(b.casDir())
+	}
+
+	for _, n := range nodes {
+		if err := p.plan(n); err != nil {
+			return nil, lexing.SingleErr(err)
+		}
+	}
+	return p.steps, nil
+}
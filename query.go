@@ -0,0 +1,540 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/text/lexing"
+)
+
+// A query is an expression over sets of nodes in the build graph:
+//
+//   - a target pattern, like "shanhu.io/proj/..."
+//   - deps(x), or deps(x, depth): x and everything x depends on
+//   - rdeps(u, x), or rdeps(u, x, depth): nodes in u that depend on x,
+//     including x
+//   - somepath(a, b): a dependency path from a node in a to a node in b
+//   - kind(k, x): nodes in x whose rule type, or node type if not a
+//     rule, fully matches regular expression k
+//   - a + b, a union b; a - b, a except b; a ^ b, a intersect b
+//
+// Set operators are left associative and have the same precedence.
+
+type queryToken struct {
+	s      string
+	pos    int  // Offset in the query.
+	quoted bool // A quoted string; never an operator or a punctuation.
+}
+
+func (t *queryToken) is(s string) bool {
+	return t != nil && !t.quoted && t.s == s
+}
+
+// queryDelims are the characters that end a word.
+const queryDelims = " \t\n\r(),\""
+
+func tokenizeQuery(q string) ([]*queryToken, error) {
+	var toks []*queryToken
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, &queryToken{s: string(c), pos: i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, errcode.InvalidArgf(
+					"unterminated string at %d", i,
+				)
+			}
+			toks = append(toks, &queryToken{
+				s:      q[i+1 : i+1+end],
+				pos:    i,
+				quoted: true,
+			})
+			i += end + 2
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(queryDelims, rune(q[i])) {
+				i++
+			}
+			toks = append(toks, &queryToken{s: q[start:i], pos: start})
+		}
+	}
+	return toks, nil
+}
+
+type queryExpr interface {
+	eval(q *queryEnv) (nodeSet, error)
+}
+
+// queryWord is a target pattern, or a literal argument of a function.
+type queryWord struct{ tok *queryToken }
+
+type queryFunc struct {
+	tok  *queryToken
+	args []queryExpr
+}
+
+type queryBinary struct {
+	op   string
+	a, b queryExpr
+}
+
+var queryOps = map[string]string{
+	"+":         "union",
+	"union":     "union",
+	"-":         "except",
+	"except":    "except",
+	"^":         "intersect",
+	"intersect": "intersect",
+}
+
+type queryParser struct {
+	toks []*queryToken
+	pos  int
+}
+
+func (p *queryParser) peek() *queryToken {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+	return p.toks[p.pos]
+}
+
+func (p *queryParser) next() *queryToken {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) expect(s string) error {
+	t := p.next()
+	if t == nil {
+		return errcode.InvalidArgf("expect %q, got end of query", s)
+	}
+	if !t.is(s) {
+		return errcode.InvalidArgf("expect %q at %d, got %q", s, t.pos, t.s)
+	}
+	return nil
+}
+
+func (p *queryParser) parseExpr() (queryExpr, error) {
+	x, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t == nil || t.quoted {
+			return x, nil
+		}
+		op, ok := queryOps[t.s]
+		if !ok {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		x = &queryBinary{op: op, a: x, b: y}
+	}
+}
+
+func (p *queryParser) parseTerm() (queryExpr, error) {
+	t := p.next()
+	if t == nil {
+		return nil, errcode.InvalidArgf("unexpected end of query")
+	}
+	if t.is("(") {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	if !t.quoted && (t.s == ")" || t.s == ",") {
+		return nil, errcode.InvalidArgf("unexpected %q at %d", t.s, t.pos)
+	}
+	if !p.peek().is("(") || t.quoted {
+		return &queryWord{tok: t}, nil
+	}
+
+	p.next() // "("
+	f := &queryFunc{tok: t}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		f.args = append(f.args, arg)
+		if !p.peek().is(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseQuery(q string) (queryExpr, error) {
+	toks, err := tokenizeQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	x, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, errcode.InvalidArgf("unexpected %q at %d", t.s, t.pos)
+	}
+	return x, nil
+}
+
+type queryEnv struct {
+	loader  *loader
+	nodes   map[string]*buildNode
+	workSrc string
+
+	rdeps map[string][]string // Reverse dependencies; built on demand.
+}
+
+func (q *queryEnv) reverseDeps() map[string][]string {
+	if q.rdeps != nil {
+		return q.rdeps
+	}
+	q.rdeps = make(map[string][]string)
+	for name, n := range q.nodes {
+		for _, dep := range n.deps {
+			q.rdeps[dep] = append(q.rdeps[dep], name)
+		}
+	}
+	for _, list := range q.rdeps {
+		sort.Strings(list)
+	}
+	return q.rdeps
+}
+
+// closure returns the nodes reachable from the nodes in start by
+// following edges, at most depth steps when depth is not negative.
+func closure(
+	start nodeSet, depth int, edges func(name string) []string,
+) nodeSet {
+	ret := make(nodeSet)
+	cur := start.list()
+	for _, name := range cur {
+		ret[name] = true
+	}
+	for d := 0; len(cur) > 0 && (depth < 0 || d < depth); d++ {
+		var next []string
+		for _, name := range cur {
+			for _, to := range edges(name) {
+				if !ret[to] {
+					ret[to] = true
+					next = append(next, to)
+				}
+			}
+		}
+		cur = next
+	}
+	return ret
+}
+
+func (w *queryWord) eval(q *queryEnv) (nodeSet, error) {
+	if w.tok.quoted {
+		return nil, errcode.InvalidArgf(
+			"unexpected string %q at %d", w.tok.s, w.tok.pos,
+		)
+	}
+	pattern := w.tok.s
+	if q.workSrc != "" {
+		pattern = absPattern(q.workSrc, pattern)
+	}
+	names, err := expandPatterns(q.loader, []string{pattern})
+	if err != nil {
+		return nil, err
+	}
+	set := make(nodeSet)
+	for _, name := range names {
+		if _, ok := q.nodes[name]; !ok {
+			return nil, errcode.NotFoundf("%q not found", name)
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+func (f *queryFunc) literal(i int) (string, error) {
+	w, ok := f.args[i].(*queryWord)
+	if !ok {
+		return "", errcode.InvalidArgf(
+			"argument %d of %s() is not a literal", i+1, f.tok.s,
+		)
+	}
+	return w.tok.s, nil
+}
+
+func (f *queryFunc) depth(i int) (int, error) {
+	if i >= len(f.args) {
+		return -1, nil
+	}
+	s, err := f.literal(i)
+	if err != nil {
+		return 0, err
+	}
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 {
+		return 0, errcode.InvalidArgf(
+			"invalid depth %q of %s()", s, f.tok.s,
+		)
+	}
+	return d, nil
+}
+
+func (f *queryFunc) checkArgs(min, max int) error {
+	n := len(f.args)
+	if n >= min && n <= max {
+		return nil
+	}
+	want := strconv.Itoa(min)
+	if max > min {
+		want = fmt.Sprintf("%d to %d", min, max)
+	}
+	return errcode.InvalidArgf(
+		"%s() at %d takes %s arguments, got %d",
+		f.tok.s, f.tok.pos, want, n,
+	)
+}
+
+func (f *queryFunc) evalArgs(q *queryEnv, n int) ([]nodeSet, error) {
+	var sets []nodeSet
+	for i := 0; i < n; i++ {
+		s, err := f.args[i].eval(q)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, s)
+	}
+	return sets, nil
+}
+
+func (f *queryFunc) eval(q *queryEnv) (nodeSet, error) {
+	switch f.tok.s {
+	case "deps":
+		if err := f.checkArgs(1, 2); err != nil {
+			return nil, err
+		}
+		depth, err := f.depth(1)
+		if err != nil {
+			return nil, err
+		}
+		sets, err := f.evalArgs(q, 1)
+		if err != nil {
+			return nil, err
+		}
+		return closure(sets[0], depth, func(name string) []string {
+			return q.nodes[name].deps
+		}), nil
+	case "rdeps":
+		if err := f.checkArgs(2, 3); err != nil {
+			return nil, err
+		}
+		depth, err := f.depth(2)
+		if err != nil {
+			return nil, err
+		}
+		sets, err := f.evalArgs(q, 2)
+		if err != nil {
+			return nil, err
+		}
+		universe := sets[0]
+		rdeps := q.reverseDeps()
+		ret := closure(sets[1], depth, func(name string) []string {
+			var list []string
+			for _, from := range rdeps[name] {
+				if universe[from] {
+					list = append(list, from)
+				}
+			}
+			return list
+		})
+		for name := range ret {
+			if !universe[name] {
+				delete(ret, name)
+			}
+		}
+		return ret, nil
+	case "somepath":
+		if err := f.checkArgs(2, 2); err != nil {
+			return nil, err
+		}
+		sets, err := f.evalArgs(q, 2)
+		if err != nil {
+			return nil, err
+		}
+		return q.somepath(sets[0], sets[1]), nil
+	case "kind":
+		if err := f.checkArgs(2, 2); err != nil {
+			return nil, err
+		}
+		k, err := f.literal(0)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile("^(?:" + k + ")$")
+		if err != nil {
+			return nil, errcode.InvalidArgf("invalid kind %q: %s", k, err)
+		}
+		set, err := f.args[1].eval(q)
+		if err != nil {
+			return nil, err
+		}
+		ret := make(nodeSet)
+		for name := range set {
+			n := q.nodes[name]
+			kind := n.typ
+			if n.typ == nodeRule {
+				kind = n.ruleType
+			}
+			if re.MatchString(kind) {
+				ret[name] = true
+			}
+		}
+		return ret, nil
+	}
+	return nil, errcode.InvalidArgf(
+		"unknown function %q at %d", f.tok.s, f.tok.pos,
+	)
+}
+
+// somepath finds a shortest dependency path from a node in from to a
+// node in to.
+func (q *queryEnv) somepath(from, to nodeSet) nodeSet {
+	prev := make(map[string]string)
+	visited := make(nodeSet)
+	cur := from.list()
+	for _, name := range cur {
+		visited[name] = true
+	}
+
+	for len(cur) > 0 {
+		var next []string
+		for _, name := range cur {
+			if to[name] {
+				path := make(nodeSet)
+				for {
+					path[name] = true
+					p, ok := prev[name]
+					if !ok {
+						return path
+					}
+					name = p
+				}
+			}
+			for _, dep := range q.nodes[name].deps {
+				if !visited[dep] {
+					visited[dep] = true
+					prev[dep] = name
+					next = append(next, dep)
+				}
+			}
+		}
+		cur = next
+	}
+	return make(nodeSet)
+}
+
+func (b *queryBinary) eval(q *queryEnv) (nodeSet, error) {
+	x, err := b.a.eval(q)
+	if err != nil {
+		return nil, err
+	}
+	y, err := b.b.eval(q)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(nodeSet)
+	switch b.op {
+	case "union":
+		for name := range x {
+			ret[name] = true
+		}
+		for name := range y {
+			ret[name] = true
+		}
+	case "except":
+		for name := range x {
+			if !y[name] {
+				ret[name] = true
+			}
+		}
+	case "intersect":
+		for name := range x {
+			if y[name] {
+				ret[name] = true
+			}
+		}
+	default:
+		return nil, errcode.Internalf("unknown operator %q", b.op)
+	}
+	return ret, nil
+}
+
+// Query evaluates a query over the build graph of the workspace, and
+// returns the resulting nodes, sorted by name.
+func (b *Builder) Query(query string) ([]*GraphNode, []*lexing.Error) {
+	x, err := parseQuery(query)
+	if err != nil {
+		return nil, lexing.SingleErr(errcode.Annotate(err, "parse query"))
+	}
+
+	l, errs := loadGraph(b.env)
+	if errs != nil {
+		return nil, errs
+	}
+
+	q := &queryEnv{
+		loader:  l,
+		nodes:   l.loaded,
+		workSrc: b.env.workSrcPath,
+	}
+	set, err := x.eval(q)
+	if err != nil {
+		return nil, lexing.SingleErr(err)
+	}
+	return graphNodes(l.loaded, set), nil
+}
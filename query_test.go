@@ -0,0 +1,187 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"reflect"
+	"testing"
+
+	"shanhu.io/misc/errcode"
+)
+
+func testQueryEnv(t *testing.T) *queryEnv {
+	env := &env{
+		srcDir: t.TempDir(),
+		workspace: &Workspace{
+			RepoMap: &RepoMap{Src: map[string]string{"p": "", "q": ""}},
+		},
+	}
+	l := newLoader(env)
+	for _, n := range []*buildNode{
+		{name: "p/lib.go", typ: nodeSrc},
+		{name: "p/main.go", typ: nodeSrc},
+		{
+			name:     "p/lib",
+			typ:      nodeRule,
+			ruleType: "go_library",
+			deps:     []string{"p/lib.go"},
+		},
+		{
+			name:     "p/bin",
+			typ:      nodeRule,
+			ruleType: "go_binary",
+			deps:     []string{"p/lib", "p/main.go"},
+		},
+		{
+			name:     "p/img",
+			typ:      nodeRule,
+			ruleType: "docker_build",
+			deps:     []string{"p/bin"},
+		},
+		{
+			name:     "q/tool",
+			typ:      nodeRule,
+			ruleType: "exec",
+			deps:     []string{"p/lib"},
+		},
+	} {
+		l.register(n)
+	}
+	return &queryEnv{loader: l, nodes: l.nodes}
+}
+
+func TestQuery(t *testing.T) {
+	for _, test := range []struct {
+		q    string
+		want []string
+	}{
+		{"p/bin", []string{"p/bin"}},
+		{"p:bin", []string{"p/bin"}},
+		{"p/...", []string{"p/bin", "p/img", "p/lib"}},
+		{
+			"deps(p/bin)",
+			[]string{"p/bin", "p/lib", "p/lib.go", "p/main.go"},
+		},
+		{"deps(p/img, 1)", []string{"p/bin", "p/img"}},
+		{"deps(p/img, 0)", []string{"p/img"}},
+		{
+			"rdeps(..., p/lib)",
+			[]string{"p/bin", "p/img", "p/lib", "q/tool"},
+		},
+		{"rdeps(..., p/lib, 1)", []string{"p/bin", "p/lib", "q/tool"}},
+		{"rdeps(p/..., p/lib)", []string{"p/bin", "p/img", "p/lib"}},
+		{"rdeps(q/..., p/lib)", []string{"q/tool"}},
+		{
+			"somepath(p/img, p/lib.go)",
+			[]string{"p/bin", "p/img", "p/lib", "p/lib.go"},
+		},
+		{"somepath(q/tool, p/main.go)", nil},
+		{"somepath(p/bin, p/bin)", []string{"p/bin"}},
+		{"kind(go_.*, ...)", []string{"p/bin", "p/lib"}},
+		{"kind(go, ...)", nil},
+		{`kind("go_binary", ...)`, []string{"p/bin"}},
+		{"kind(src, deps(p/bin))", []string{"p/lib.go", "p/main.go"}},
+		{"p/bin + q/tool", []string{"p/bin", "q/tool"}},
+		{"p/bin union q/tool", []string{"p/bin", "q/tool"}},
+		{"p/... - p/lib", []string{"p/bin", "p/img"}},
+		{"p/... except p/lib", []string{"p/bin", "p/img"}},
+		{"... ^ deps(p/bin)", []string{"p/bin", "p/lib"}},
+		{"... intersect deps(p/bin)", []string{"p/bin", "p/lib"}},
+
+		// Operators are left associative and have the same precedence.
+		{"p/img - p/img + p/bin", []string{"p/bin"}},
+		{"p/img - (p/img + p/bin)", nil},
+		{"p/lib + p/img ^ p/img", []string{"p/img"}},
+		{"p/lib + (p/img ^ p/img)", []string{"p/img", "p/lib"}},
+		{"p/... ^ q/tool + q/tool", []string{"q/tool"}},
+		{
+			"deps(p/img) - deps(p/bin, 1) ^ kind(src, deps(p/img))",
+			[]string{"p/lib.go"},
+		},
+	} {
+		x, err := parseQuery(test.q)
+		if err != nil {
+			t.Errorf("parse %q: %s", test.q, err)
+			continue
+		}
+		set, err := x.eval(testQueryEnv(t))
+		if err != nil {
+			t.Errorf("eval %q: %s", test.q, err)
+			continue
+		}
+		if got := set.list(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("query %q, got %q, want %q", test.q, got, test.want)
+		}
+	}
+}
+
+func TestQueryParseError(t *testing.T) {
+	for _, q := range []string{
+		"",
+		"p/bin +",
+		"p/bin p/img",
+		"(p/bin",
+		"p/bin)",
+		"deps(p/bin",
+		"deps(p/bin))",
+		"deps(p/bin,)",
+		"deps()",
+		"deps(,)",
+		", p/bin",
+		`"p/bin`,
+	} {
+		if _, err := parseQuery(q); !errcode.IsInvalidArg(err) {
+			t.Errorf("parse %q, got error %v, want invalid arg", q, err)
+		}
+	}
+}
+
+func TestQueryEvalError(t *testing.T) {
+	for _, test := range []struct {
+		q        string
+		notFound bool
+	}{
+		{q: "nope(p/bin)"},
+		{q: `"p/bin"`},
+		{q: "deps(p/bin, x)"},
+		{q: "deps(p/bin, -1)"},
+		{q: "deps(p/bin, 1, 2)"},
+		{q: "rdeps(p/bin)"},
+		{q: "somepath(p/bin)"},
+		{q: "kind(go_binary)"},
+		{q: "kind(deps(p/bin), ...)"},
+		{q: `kind("[", ...)`},
+		{q: "p/nope", notFound: true},
+		{q: "x/...", notFound: true},
+		{q: "deps(p/nope)", notFound: true},
+	} {
+		x, err := parseQuery(test.q)
+		if err != nil {
+			t.Errorf("parse %q: %s", test.q, err)
+			continue
+		}
+		_, err = x.eval(testQueryEnv(t))
+		if test.notFound {
+			if !errcode.IsNotFound(err) {
+				t.Errorf(
+					"eval %q, got error %v, want not found", test.q, err,
+				)
+			}
+		} else if !errcode.IsInvalidArg(err) {
+			t.Errorf("eval %q, got error %v, want invalid arg", test.q, err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"shanhu.io/misc/errcode"
+	"shanhu.io/misc/httputil"
+)
+
+// remoteCacheTimeout is the timeout of connecting to the remote cache
+// server and of waiting for its responses. Transferring the content is not
+// limited, as outputs can be large, but stops when the build is canceled.
+const remoteCacheTimeout = 30 * time.Second
+
+// remoteCache is a client of a remote HTTP build cache. See package
+// shanhu.io/caco3/cacheserver for the protocol.
+type remoteCache struct {
+	server   *url.URL
+	client   *http.Client
+	readOnly bool
+}
+
+func newRemoteCache(server string, readOnly bool) (*remoteCache, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errcode.Annotate(err, "parse server address")
+	}
+	dialer := &net.Dialer{Timeout: remoteCacheTimeout}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   remoteCacheTimeout,
+		ResponseHeaderTimeout: remoteCacheTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &remoteCache{
+		server:   u,
+		client:   &http.Client{Transport: tr},
+		readOnly: readOnly,
+	}, nil
+}
+
+// do sends a request to the server. n is the size of body, or -1 when
+// unknown.
+func (c *remoteCache) do(
+	ctx context.Context, method, p string, body io.Reader, n int64,
+) (*http.Response, error) {
+	u := *c.server
+	u.Path = path.Join(u.Path, p)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil && n >= 0 {
+		req.ContentLength = n
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, httputil.RespError(resp)
+	}
+	return resp, nil
+}
+
+func remoteCacheKey(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+func remoteActionPath(digest string) string {
+	return "/ac/" + remoteCacheKey(digest)
+}
+
+func remoteBlobPath(sum string) string { return "/cas/" + sum }
+
+// remoteCachable checks if the outputs of a built can be saved in the remote
+// cache. Only regular files and symlinks with content hashes can be saved.
+func remoteCachable(b *built) bool {
+	return len(b.Dockers) == 0 && restorable(b)
+}
+
+func (c *remoteCache) get(ctx context.Context, digest string) (
+	*built, error,
+) {
+	resp, err := c.do(ctx, http.MethodGet, remoteActionPath(digest), nil, -1)
+	if err != nil {
+		if errcode.IsNotFound(err) {
+			return nil, errNotFoundInCache
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b := new(built)
+	if err := json.NewDecoder(resp.Body).Decode(b); err != nil {
+		return nil, errcode.Annotate(err, "decode action result")
+	}
+	if !remoteCachable(b) {
+		return nil, errNotFoundInCache
+	}
+	return b, nil
+}
+
+func (c *remoteCache) openBlob(ctx context.Context, sum string) (
+	io.ReadCloser, error,
+) {
+	resp, err := c.do(ctx, http.MethodGet, remoteBlobPath(sum), nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// restore downloads all the outputs of b into the output directory,
+// where meta is the rule that builds b.
+func (c *remoteCache) restore(
+	ctx context.Context, env *env, meta *buildRuleMeta, b *built,
+) error {
+	if err := checkRestoreOuts(meta, b); err != nil {
+		return errcode.Annotate(err, "check outputs")
+	}
+	for _, out := range b.Outs {
+		open := func() (io.ReadCloser, error) {
+			return c.openBlob(ctx, out.Sha256)
+		}
+		if err := restoreOut(env, out, open); err != nil {
+			return errcode.Annotatef(err, "restore %q", out.Name)
+		}
+	}
+	return nil
+}
+
+func (c *remoteCache) putBlob(
+	ctx context.Context, f string, size int64, sum string,
+) error {
+	r, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	resp, err := c.do(ctx, http.MethodPut, remoteBlobPath(sum), r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// put uploads the outputs of b as blobs, and then saves b as the action
+// result of digest.
+func (c *remoteCache) put(
+	ctx context.Context, env *env, digest string, b *built,
+) error {
+	if c.readOnly || !remoteCachable(b) {
+		return nil
+	}
+	for _, out := range b.Outs {
+		if out.Symlink != "" {
+			continue
+		}
+		f := env.out(out.Name)
+		if err := c.putBlob(ctx, f, out.Size, out.Sha256); err != nil {
+			return errcode.Annotatef(err, "upload %q", out.Name)
+		}
+	}
+	bs, err := json.Marshal(b)
+	if err != nil {
+		return errcode.Annotate(err, "encode action result")
+	}
+	resp, err := c.do(
+		ctx, http.MethodPut, remoteActionPath(digest),
+		bytes.NewReader(bs), int64(len(bs)),
+	)
+	if err != nil {
+		return errcode.Annotate(err, "save action result")
+	}
+	return resp.Body.Close()
+}
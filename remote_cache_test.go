@@ -0,0 +1,93 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"shanhu.io/caco3/cacheserver"
+)
+
+func TestRemoteCache(t *testing.T) {
+	dir := t.TempDir()
+	s := httptest.NewServer(cacheserver.New(filepath.Join(dir, "cache")))
+	defer s.Close()
+
+	c, err := newRemoteCache(s.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := &env{outDir: filepath.Join(dir, "out")}
+	const content = "hello"
+	f, err := env.prepareOut("p/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	b := &built{
+		Outs: []*fileStat{{
+			Name:   "p/a.txt",
+			Type:   fileTypeOut,
+			Size:   int64(len(content)),
+			Mode:   0644,
+			Sha256: hex.EncodeToString(sum[:]),
+		}},
+	}
+
+	ctx := context.Background()
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if _, err := c.get(ctx, digest); err != errNotFoundInCache {
+		t.Fatalf("get before put, got %v, want not found", err)
+	}
+	if err := c.put(ctx, env, digest, b); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.get(ctx, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(f); err != nil {
+		t.Fatal(err)
+	}
+	meta := &buildRuleMeta{outs: []string{"p/a.txt"}}
+	if err := c.restore(ctx, env, meta, got); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != content {
+		t.Errorf("restored %q, want %q", bs, content)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.get(canceled, digest); !isCanceled(err) {
+		t.Errorf("get with canceled context, got %v", err)
+	}
+}
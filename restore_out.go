@@ -0,0 +1,147 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+)
+
+// checkRestoreOuts checks that the outputs of b, which comes from a cache,
+// are exactly the outputs of the rule, plus the files in its output
+// directories. Output names and symlinks must stay in the output
+// directory.
+func checkRestoreOuts(meta *buildRuleMeta, b *built) error {
+	want := make(map[string]bool)
+	for _, out := range meta.outs {
+		want[out] = true
+	}
+	var dirs []string
+	for _, out := range meta.dirOuts {
+		dirs = append(dirs, strings.TrimSuffix(out, fileSetExt)+"/")
+	}
+	inDirs := func(name string) bool {
+		for _, dir := range dirs {
+			if strings.HasPrefix(name, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := make(map[string]bool)
+	for _, out := range b.Outs {
+		name := out.Name
+		if !fs.ValidPath(name) || name == "." {
+			return errcode.InvalidArgf("invalid output name %q", name)
+		}
+		if seen[name] {
+			return errcode.InvalidArgf("output %q restored twice", name)
+		}
+		seen[name] = true
+		if !want[name] && !inDirs(name) {
+			return errcode.InvalidArgf("%q is not an output", name)
+		}
+		if out.Symlink != "" {
+			if path.IsAbs(out.Symlink) {
+				return errcode.InvalidArgf(
+					"output %q links to absolute path", name,
+				)
+			}
+			target := path.Join(path.Dir(name), out.Symlink)
+			if !fs.ValidPath(target) {
+				return errcode.InvalidArgf(
+					"output %q links outside of outputs", name,
+				)
+			}
+		}
+	}
+	for _, out := range meta.outs {
+		if !seen[out] {
+			return errcode.InvalidArgf("output %q missing", out)
+		}
+	}
+	return nil
+}
+
+// restoreTempExt is the file extension of the temp files of outputs
+// being restored.
+const restoreTempExt = ".restore"
+
+// restoreOut restores output file out from a cached copy. open opens the
+// cached content, which is verified against the sha256 of out before it
+// replaces the output file.
+func restoreOut(
+	env *env, out *fileStat, open func() (io.ReadCloser, error),
+) error {
+	if out.Type != fileTypeOut {
+		return errcode.InvalidArgf("%q is not an output", out.Name)
+	}
+	f, err := env.prepareOut(out.Name)
+	if err != nil {
+		return errcode.Annotate(err, "prepare output")
+	}
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return errcode.Annotate(err, "remove old output")
+	}
+
+	if out.Symlink != "" {
+		return os.Symlink(out.Symlink, f)
+	}
+	if out.Sha256 == "" {
+		return errcode.InvalidArgf("%q has no content hash", out.Name)
+	}
+
+	r, err := open()
+	if err != nil {
+		return errcode.Annotate(err, "open cached content")
+	}
+	defer r.Close()
+
+	tmp := f + restoreTempExt
+	sum, err := downloadToFile(tmp, r)
+	if err != nil {
+		os.Remove(tmp)
+		return errcode.Annotate(err, "copy cached content")
+	}
+	if sum != out.Sha256 {
+		os.Remove(tmp)
+		return errcode.Internalf(
+			"sha256 mismatch, want %s, got %s", out.Sha256, sum,
+		)
+	}
+	if err := os.Chmod(tmp, fs.FileMode(out.Mode).Perm()); err != nil {
+		os.Remove(tmp)
+		return errcode.Annotate(err, "set mode")
+	}
+	return os.Rename(tmp, f)
+}
+
+// restorable checks if all outputs in b can be restored from content
+// hashes.
+func restorable(b *built) bool {
+	for _, out := range b.Outs {
+		if out.Symlink == "" && out.Sha256 == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"testing"
+)
+
+func TestCheckRestoreOuts(t *testing.T) {
+	meta := &buildRuleMeta{
+		outs:    []string{"p/a.txt", "p/dist.fileset"},
+		dirOuts: []string{"p/dist.fileset"},
+	}
+	outs := func(names ...string) *built {
+		b := new(built)
+		for _, name := range names {
+			b.Outs = append(b.Outs, &fileStat{Name: name})
+		}
+		return b
+	}
+
+	for _, test := range []struct {
+		name string
+		b    *built
+		ok   bool
+	}{
+		{"exact", outs("p/a.txt", "p/dist.fileset"), true},
+		{"dir file", outs("p/a.txt", "p/dist.fileset", "p/dist/x"), true},
+		{"missing", outs("p/a.txt"), false},
+		{"extra", outs("p/a.txt", "p/dist.fileset", "p/b.txt"), false},
+		{"dup", outs("p/a.txt", "p/a.txt", "p/dist.fileset"), false},
+		{"escape", outs("p/a.txt", "p/dist.fileset", "p/dist/../../x"), false},
+		{"abs", outs("/p/a.txt", "p/dist.fileset"), false},
+	} {
+		err := checkRestoreOuts(meta, test.b)
+		if test.ok && err != nil {
+			t.Errorf("%s: got error: %s", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: want error, got nil", test.name)
+		}
+	}
+
+	for _, test := range []struct {
+		link string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"../p/a.txt", true},
+		{"../../etc/passwd", false},
+		{"/etc/passwd", false},
+	} {
+		b := outs("p/a.txt", "p/dist.fileset")
+		b.Outs[0].Symlink = test.link
+		err := checkRestoreOuts(meta, b)
+		if test.ok && err != nil {
+			t.Errorf("link %q: got error: %s", test.link, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("link %q: want error, got nil", test.link)
+		}
+	}
+}
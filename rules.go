@@ -15,6 +15,12 @@
 
 package caco3
 
+// String fields of rules can reference variables declared in the
+// workspace or build file as ${name}, which are expanded when the build
+// file is loaded; see Vars. References to undeclared variables, like
+// ${HOME} in a shell command, are kept as is. $${name} is an escape that
+// always expands to a literal ${name}.
+
 const (
 	ruleFileSet     = "file_set"
 	ruleBundle      = "bundle"
@@ -22,8 +28,36 @@ const (
 	ruleDockerBuild = "docker_build"
 	ruleDockerRun   = "docker_run"
 	ruleDownload    = "download"
+	ruleExec        = "exec"
+	ruleGoBinary    = "go_binary"
+	ruleGoTest      = "go_test"
+	ruleNpmBuild    = "npm_build"
+	ruleTar         = "tar"
+	ruleZip         = "zip"
+
+	entryPackage        = "package"
+	entryVars           = "vars"
+	entryDockerRegistry = "docker_registry"
 )
 
+// Package sets the properties of the package of a build file. A build
+// file can have at most one package entry.
+//
+// A visibility list contains entries of:
+//
+//   - "public": visible to all packages
+//   - "private": only visible to rules in the same package
+//   - "dir": visible to package dir
+//   - "dir/...": visible to package dir and all packages under dir
+//
+// Package paths are relative to the source directory, like
+// "shanhu.io/proj". Rules are always visible to the rules in the same
+// package. When there is no visibility set, the rule is public.
+type Package struct {
+	// Default visibility of the rules in the package.
+	DefaultVisibility []string `json:",omitempty"`
+}
+
 // FileSet selects a set of files.
 type FileSet struct {
 	Name string
@@ -39,6 +73,9 @@ type FileSet struct {
 
 	// Merge in other file sets
 	Include []string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
 }
 
 // Bundle is a set of build rules in a bundle. A bundle has no build actions;
@@ -49,6 +86,9 @@ type Bundle struct {
 
 	// Other rule names.
 	Deps []string
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
 }
 
 // DockerPull is a rule to pull down a docker container image.
@@ -57,6 +97,24 @@ type DockerPull struct {
 	Pull      string `json:",omitempty"`
 	Digest    string `json:",omitempty"`
 	OutputTar bool   `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// ArchiveOptions are the options of unpacking an archive input. Archive
+// inputs can be zip files or tarballs, which are ".tar", ".tar.gz",
+// ".tgz", ".tar.zst" or ".tzst" files. Symlinks in archives must be
+// relative and stay inside the unpacked files; hard links are unpacked as
+// copies of the linked files.
+type ArchiveOptions struct {
+	// Only unpack files under this directory in the archive.
+	Subdir string `json:",omitempty"`
+
+	// Number of leading directories to strip from the paths of the
+	// files, like the --strip-components flag of tar. Applied after
+	// filtering with Subdir.
+	StripComponents int `json:",omitempty"`
 }
 
 // DockerBuild is a rule to build a docker container image.
@@ -69,6 +127,15 @@ type DockerBuild struct {
 	PrefixDir    string   `json:",omitempty"`
 	Args         []string `json:",omitempty"`
 	OutputTar    bool     `json:",omitempty"`
+
+	// Options of unpacking archive inputs, keyed by the archive input.
+	ArchiveOptions map[string]*ArchiveOptions `json:",omitempty"`
+
+	// Timeout of the build, like "30m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
 }
 
 // DockerRun is a rule to run a command inside a docker container image.
@@ -83,6 +150,25 @@ type DockerRun struct {
 
 	Command []string `json:",omitempty"`
 
+	// Network mode of the container; "none", "bridge" or "host". Default
+	// is "none", so that the command cannot depend on the network.
+	Network string `json:",omitempty"`
+
+	// Memory limit, like "512m", "512mb" or "1.5g". Empty means no limit.
+	Memory string `json:",omitempty"`
+
+	// Number of CPUs, like 1.5. Zero means no limit.
+	CPUs float64 `json:",omitempty"`
+
+	// Map from mount points to options of tmpfs mounts, like "size=64m".
+	Tmpfs map[string]string `json:",omitempty"`
+
+	// Mounts the root file system of the container as read only.
+	ReadOnlyRootfs bool `json:",omitempty"`
+
+	// Linux capabilities to drop, like "ALL" or "NET_RAW".
+	CapDrop []string `json:",omitempty"`
+
 	// Map from input to file inside the container.
 	Input map[string]string
 
@@ -90,11 +176,158 @@ type DockerRun struct {
 	// inside the container.
 	ArchiveInput map[string]string
 
+	// Options of unpacking archive inputs, keyed by the archive input.
+	ArchiveOptions map[string]*ArchiveOptions `json:",omitempty"`
+
 	// Map from output path to file inside the container.
 	Output map[string]string `json:",omitempty"`
 
+	// Map from output directory to directory inside the container. The
+	// directory is copied out as a whole, and its files are listed in
+	// the file set output "<dir>.fileset", which can be used as an input
+	// or be included in file sets.
+	OutputDir map[string]string `json:",omitempty"`
+
+	// Extra dependencies.
+	Deps []string `json:",omitempty"`
+
+	// Timeout of the run, like "30m". The container is killed when it
+	// times out. Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// Exec is a rule to run a command on the host, without docker. The
+// command runs in a scratch directory under the output directory, with
+// only the declared inputs copied in.
+type Exec struct {
+	Name string
+
+	// Command and its arguments. The command is looked up in PATH.
+	Command []string
+
+	// Environment variables, like Envs in DockerRun. PATH is always
+	// passed in from the host.
+	Envs []string `json:",omitempty"`
+
+	// Map from input to file in the scratch directory. An input can also
+	// be a file set rule or a file set output like "dist.fileset", which
+	// is mapped to a directory; the files in the set are copied into the
+	// directory with their full paths, like "dir/shanhu.io/proj/a.txt".
+	// Symlinks are copied as symlinks.
+	Input map[string]string `json:",omitempty"`
+
+	// Map from output path to file in the scratch directory.
+	Output map[string]string `json:",omitempty"`
+
 	// Extra dependencies.
 	Deps []string `json:",omitempty"`
+
+	// Timeout of the command, like "5m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// GoBinary is a rule to build a Go binary. Binaries are always built
+// with CGO_ENABLED=0, so that they are static and do not depend on the C
+// libraries of the build host.
+type GoBinary struct {
+	Name string
+
+	// Directory of the Go module, relative to the build file. Default is
+	// the directory of the build file.
+	Module string `json:",omitempty"`
+
+	// Package to build, relative to the module, like "./cmd/foo". Default
+	// is the module directory.
+	Package string `json:",omitempty"`
+
+	// Output binary file.
+	Output string
+
+	GOOS    string   `json:",omitempty"`
+	GOARCH  string   `json:",omitempty"`
+	Ldflags string   `json:",omitempty"`
+	Tags    []string `json:",omitempty"`
+
+	// Docker image rule of the Go toolchain to build with, like a pinned
+	// docker_pull rule. When empty, the go command on the host is used.
+	// The version of the host toolchain is not part of the digest.
+	Toolchain string `json:",omitempty"`
+
+	// Timeout of the build, like "10m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// GoTest is a rule to run Go tests. The output of the tests is saved in
+// a .testlog output file. Like GoBinary, tests run with CGO_ENABLED=0.
+type GoTest struct {
+	Name string
+
+	// Directory of the Go module, relative to the build file. Default is
+	// the directory of the build file.
+	Module string `json:",omitempty"`
+
+	// Packages to test, relative to the module. Default is "./...".
+	Packages []string `json:",omitempty"`
+
+	GOOS    string   `json:",omitempty"`
+	GOARCH  string   `json:",omitempty"`
+	Ldflags string   `json:",omitempty"`
+	Tags    []string `json:",omitempty"`
+
+	// Docker image rule of the Go toolchain. See GoBinary.
+	Toolchain string `json:",omitempty"`
+
+	// Timeout of the tests, like "10m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// NpmBuild is a rule to build a Node.js package with npm in a node
+// container image. It runs "npm ci" and then the script. The
+// node_modules directory is cached in the output directory by the digest
+// of the lockfile, package.json and the image, so "npm ci" only runs when
+// they change. The output directory of the script is saved as a tarball
+// output named after the rule, with a ".tar" suffix.
+type NpmBuild struct {
+	Name string
+
+	// Directory of the package, relative to the build file. Default is
+	// the directory of the build file.
+	Dir string `json:",omitempty"`
+
+	// Lockfile of the package, relative to the package directory.
+	// Default is "package-lock.json".
+	Lockfile string `json:",omitempty"`
+
+	// Script in package.json to run, like "build".
+	Script string
+
+	// Docker image rule of node, like a pinned docker_pull rule.
+	Image string
+
+	// Directory that the script writes the outputs into, relative to the
+	// package directory, like "dist".
+	OutputDir string
+
+	// Environment variables, like Envs in DockerRun.
+	Envs []string `json:",omitempty"`
+
+	// Timeout of the build, like "10m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
 }
 
 // Download is a rule to download an artifact from the Internet.
@@ -103,4 +336,64 @@ type Download struct {
 	URL      string
 	Checksum string
 	Output   string
+
+	// Timeout of the download, like "5m". Empty means no timeout.
+	Timeout string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// Tar packs files into a tarball. The output is the name of the rule
+// with ".tar", ".tar.gz" or ".tar.zst" appended, depending on the
+// compression. Files are sorted by name, and all headers use the same
+// modification time and owner, so the tarball is reproducible.
+type Tar struct {
+	Name string
+
+	// Input files or file set rules.
+	Input []string
+
+	// Directory to strip from the paths of the input files, like
+	// PrefixDir in DockerBuild. "." means the directory of the build
+	// file. All input files must be under this directory.
+	StripPrefix string `json:",omitempty"`
+
+	// Directory to prepend to the paths in the tarball.
+	AddPrefix string `json:",omitempty"`
+
+	// Compression of the tarball; "gzip", "zstd", or empty for none.
+	Compress string `json:",omitempty"`
+
+	// Modification time of all files, in RFC3339 format. Default is
+	// 1980-01-01T00:00:00Z.
+	ModTime string `json:",omitempty"`
+
+	UserID  int `json:",omitempty"`
+	GroupID int `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
+}
+
+// Zip packs files into a zip file, which is the name of the rule with
+// ".zip" appended. Like Tar, the output is reproducible.
+type Zip struct {
+	Name string
+
+	// Input files or file set rules.
+	Input []string
+
+	// Directory to strip from the paths of the input files. See Tar.
+	StripPrefix string `json:",omitempty"`
+
+	// Directory to prepend to the paths in the zip file.
+	AddPrefix string `json:",omitempty"`
+
+	// Modification time of all files, in RFC3339 format. Default is
+	// 1980-01-01T00:00:00Z, the earliest time that zip supports.
+	ModTime string `json:",omitempty"`
+
+	// Packages that can depend on this rule.
+	Visibility []string `json:",omitempty"`
 }
@@ -0,0 +1,163 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"shanhu.io/misc/errcode"
+)
+
+// A target pattern is one of:
+//
+//   - a node name, like "shanhu.io/proj/rule"
+//   - "dir/...", every rule under dir, including dir itself
+//   - "dir:*" or "dir:all", every rule directly in dir
+//   - "dir:name", same as "dir/name"
+//
+// A pattern that starts with "-" is a negative pattern, which excludes
+// the nodes it matches from the nodes matched by the patterns before it.
+
+const (
+	patternRecursive = "..."
+	patternNegative  = "-"
+)
+
+// absPattern makes a pattern relative to work path w absolute.
+func absPattern(w, p string) string {
+	neg := strings.HasPrefix(p, patternNegative)
+	p = strings.TrimPrefix(p, patternNegative)
+
+	dir, target, hasTarget := strings.Cut(p, ":")
+	p = makePath(w, dir)
+	if hasTarget {
+		p += ":" + target
+	}
+	if neg {
+		p = patternNegative + p
+	}
+	return p
+}
+
+// patternMatcher returns the matching function of a wildcard pattern, or
+// nil if p names a single node. It also returns the node name of p, with
+// "dir:name" converted to "dir/name".
+func patternMatcher(p string) (string, func(n *buildNode) bool) {
+	if p == patternRecursive {
+		return p, func(*buildNode) bool { return true }
+	}
+	if dir := strings.TrimSuffix(p, "/"+patternRecursive); dir != p {
+		prefix := dir + "/"
+		return p, func(n *buildNode) bool {
+			return n.name == dir || strings.HasPrefix(n.name, prefix)
+		}
+	}
+
+	dir, target, hasTarget := strings.Cut(p, ":")
+	if !hasTarget {
+		return p, nil
+	}
+	if target == "*" || target == "all" {
+		return p, func(n *buildNode) bool {
+			d := path.Dir(n.name)
+			if d == "." {
+				d = ""
+			}
+			return d == dir
+		}
+	}
+	return path.Join(dir, target), nil
+}
+
+// loadPatternPackages loads the packages that wildcard pattern p might
+// match rules in.
+func loadPatternPackages(l *loader, p string) {
+	if p == patternRecursive {
+		l.loadAll()
+		return
+	}
+	if dir := strings.TrimSuffix(p, "/"+patternRecursive); dir != p {
+		l.loadPackagesUnder(dir)
+		return
+	}
+	if dir, _, ok := strings.Cut(p, ":"); ok && dir != "" {
+		l.loadAncestors(dir + "/")
+	}
+}
+
+// expandPatterns expands target patterns into node names, matching
+// wildcard patterns against the rules in the packages that the patterns
+// point into. Node names are kept in the order they are listed, and rules
+// matched by a wildcard pattern are sorted by name.
+func expandPatterns(l *loader, patterns []string) ([]string, error) {
+	for _, p := range patterns {
+		loadPatternPackages(l, strings.TrimPrefix(p, patternNegative))
+	}
+
+	var rules []string
+	for name, n := range l.nodes {
+		if n.typ == nodeRule {
+			rules = append(rules, name)
+		}
+	}
+	sort.Strings(rules)
+
+	var names []string
+	excluded := make(map[string]bool)
+	for _, p := range patterns {
+		neg := strings.HasPrefix(p, patternNegative)
+		p = strings.TrimPrefix(p, patternNegative)
+
+		name, match := patternMatcher(p)
+		var matched []string
+		if match == nil {
+			matched = []string{name}
+		} else {
+			for _, r := range rules {
+				if match(l.nodes[r]) {
+					matched = append(matched, r)
+				}
+			}
+			if len(matched) == 0 && !neg {
+				return nil, errcode.NotFoundf(
+					"pattern %q matches no rules", p,
+				)
+			}
+		}
+
+		for _, m := range matched {
+			if neg {
+				excluded[m] = true
+			} else {
+				delete(excluded, m)
+				names = append(names, m)
+			}
+		}
+	}
+
+	var ret []string
+	added := make(map[string]bool)
+	for _, name := range names {
+		if excluded[name] || added[name] {
+			continue
+		}
+		added[name] = true
+		ret = append(ret, name)
+	}
+	return ret, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"reflect"
+	"testing"
+
+	"shanhu.io/misc/errcode"
+)
+
+func TestAbsPattern(t *testing.T) {
+	for _, test := range []struct {
+		w, p, want string
+	}{
+		{"a", "b", "a/b"},
+		{"a", "b/...", "a/b/..."},
+		{"a", "...", "a/..."},
+		{"", "...", "..."},
+		{"a", ":all", "a:all"},
+		{"a", "b:x", "a/b:x"},
+		{"a", "/c:x", "c:x"},
+		{"a", "-b", "-a/b"},
+		{"a", "-b/...", "-a/b/..."},
+		{"a", "-/c/...", "-c/..."},
+	} {
+		got := absPattern(test.w, test.p)
+		if got != test.want {
+			t.Errorf(
+				"absPattern(%q, %q), got %q, want %q",
+				test.w, test.p, got, test.want,
+			)
+		}
+	}
+}
+
+func TestPatternMatcher(t *testing.T) {
+	names := []string{"a", "a/x", "a/b/y", "ab/z", "c"}
+
+	for _, test := range []struct {
+		p       string
+		name    string
+		matched []string // nil when p names a single node.
+	}{
+		{"a/x", "a/x", nil},
+		{"a:x", "a/x", nil},
+		{":c", "c", nil},
+		{"...", "...", names},
+		{"a/...", "a/...", []string{"a", "a/x", "a/b/y"}},
+		{"a/b/...", "a/b/...", []string{"a/b/y"}},
+		{"a:all", "a:all", []string{"a/x"}},
+		{"a:*", "a:*", []string{"a/x"}},
+		{":all", ":all", []string{"a", "c"}},
+		{"d/...", "d/...", []string{}},
+	} {
+		name, match := patternMatcher(test.p)
+		if name != test.name {
+			t.Errorf(
+				"patternMatcher(%q), got name %q, want %q",
+				test.p, name, test.name,
+			)
+		}
+		if test.matched == nil {
+			if match != nil {
+				t.Errorf("patternMatcher(%q), got a matcher", test.p)
+			}
+			continue
+		}
+		if match == nil {
+			t.Errorf("patternMatcher(%q), got no matcher", test.p)
+			continue
+		}
+
+		matched := []string{}
+		for _, name := range names {
+			if match(&buildNode{name: name}) {
+				matched = append(matched, name)
+			}
+		}
+		if !reflect.DeepEqual(matched, test.matched) {
+			t.Errorf(
+				"patternMatcher(%q), matched %q, want %q",
+				test.p, matched, test.matched,
+			)
+		}
+	}
+}
+
+func TestExpandPatterns(t *testing.T) {
+	env := &env{
+		srcDir: t.TempDir(),
+		workspace: &Workspace{
+			RepoMap: &RepoMap{Src: map[string]string{"a": "", "c": ""}},
+		},
+	}
+
+	for _, test := range []struct {
+		patterns []string
+		want     []string
+		notFound bool
+	}{
+		{
+			patterns: []string{"a/b/y"},
+			want:     []string{"a/b/y"},
+		},
+		{
+			patterns: []string{"..."},
+			want:     []string{"a/b/y", "a/b/z", "a/x", "c/w"},
+		},
+		{
+			patterns: []string{"a/..."},
+			want:     []string{"a/b/y", "a/b/z", "a/x"},
+		},
+		{
+			patterns: []string{"a:all"},
+			want:     []string{"a/x"},
+		},
+		{
+			patterns: []string{"c/w", "a/b:all"},
+			want:     []string{"c/w", "a/b/y", "a/b/z"},
+		},
+		{
+			patterns: []string{"a/...", "-a/b/..."},
+			want:     []string{"a/x"},
+		},
+		{
+			patterns: []string{"a/...", "-a/b/y"},
+			want:     []string{"a/b/z", "a/x"},
+		},
+		{
+			patterns: []string{"a/...", "-a/b/...", "a/b/z"},
+			want:     []string{"a/b/z", "a/x"},
+		},
+		{
+			patterns: []string{"a/x", "a:all"},
+			want:     []string{"a/x"},
+		},
+		{
+			patterns: []string{"a/x", "-d/..."},
+			want:     []string{"a/x"},
+		},
+		{
+			patterns: []string{"d/..."},
+			notFound: true,
+		},
+		{
+			patterns: []string{"a/x", "c/w:all"},
+			notFound: true,
+		},
+	} {
+		l := newLoader(env)
+		for _, name := range []string{"a/x", "a/b/y", "a/b/z", "c/w"} {
+			l.register(&buildNode{name: name, typ: nodeRule})
+		}
+		l.register(&buildNode{name: "a/x.go", typ: nodeSrc})
+
+		got, err := expandPatterns(l, test.patterns)
+		if test.notFound {
+			if !errcode.IsNotFound(err) {
+				t.Errorf(
+					"expandPatterns(%q), got error %v, want not found",
+					test.patterns, err,
+				)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandPatterns(%q): %s", test.patterns, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf(
+				"expandPatterns(%q), got %q, want %q",
+				test.patterns, got, test.want,
+			)
+		}
+		if errs := l.Errs(); errs != nil {
+			t.Errorf("expandPatterns(%q), load errors: %v", test.patterns, errs)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"shanhu.io/misc/errcode"
+)
+
+// parseTimeout parses the timeout of a rule. Empty string means no
+// timeout.
+func parseTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errcode.InvalidArgf("invalid timeout %q", s)
+	}
+	if d <= 0 {
+		return 0, errcode.InvalidArgf("timeout %q is not positive", s)
+	}
+	return d, nil
+}
+
+// runWithTimeout runs f with a context that times out after d. When d is
+// zero, the context only ends when ctx ends. When f fails after the
+// context ended, it returns the error of the context instead, as the
+// failure is most likely caused by the cancellation.
+func runWithTimeout(
+	ctx context.Context, d time.Duration, f func(ctx context.Context) error,
+) error {
+	if d > 0 {
+		c, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		ctx = c
+	}
+
+	if err := f(ctx); err != nil {
+		ctxErr := ctx.Err()
+		if ctxErr == nil {
+			return err
+		}
+		if errors.Is(ctxErr, context.DeadlineExceeded) {
+			return errcode.Annotatef(ctxErr, "timeout after %s", d)
+		}
+		return ctxErr
+	}
+	return nil
+}
+
+// runUntilDone runs f, which cannot be canceled, and waits until it
+// returns or until ctx ends. When ctx ends first, f is left running in the
+// background.
+func runUntilDone(ctx context.Context, f func() error) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- f() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeUntilDone runs f, which cannot be canceled, to write output file
+// out, and waits until it returns or until ctx ends. f writes into a temp
+// file, which is renamed to out only when f returns before ctx ends. So
+// when ctx ends first, f is left running in the background, but never
+// writes out.
+func writeUntilDone(
+	ctx context.Context, out string, f func(tmp string) error,
+) error {
+	dir, base := filepath.Split(out)
+	tmpFile, err := os.CreateTemp(dir, base+".*"+saveTempExt)
+	if err != nil {
+		return errcode.Annotate(err, "create temp file")
+	}
+	tmp := tmpFile.Name()
+	tmpFile.Close()
+
+	var mu sync.Mutex
+	canceled := false // out must not be written once canceled.
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := f(tmp)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil && !canceled {
+			err = os.Rename(tmp, out)
+		}
+		if err != nil || canceled {
+			os.Remove(tmp)
+		}
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		mu.Lock()
+		canceled = true
+		mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// saveTempExt is the file extension of the temp files of writeUntilDone.
+const saveTempExt = ".save"
+
+// isCanceled checks if err is caused by cancellation or timeout.
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
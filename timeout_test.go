@@ -0,0 +1,75 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteUntilDone(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "image.tar.gz")
+	write := func(tmp string) error {
+		return os.WriteFile(tmp, []byte("image"), 0644)
+	}
+
+	ctx := context.Background()
+	if err := writeUntilDone(ctx, out, write); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "image" {
+		t.Errorf("got %q, want %q", bs, "image")
+	}
+	if err := os.Remove(out); err != nil {
+		t.Fatal(err)
+	}
+
+	// When canceled, the output is not written even after f finishes.
+	ctx, cancel := context.WithCancel(ctx)
+	release := make(chan struct{})
+	err = writeUntilDone(ctx, out, func(tmp string) error {
+		cancel()
+		<-release
+		return write(tmp)
+	})
+	if err != context.Canceled {
+		t.Errorf("got error %v, want canceled", err)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got files %v after canceled", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -17,7 +17,11 @@ package caco3
 
 import (
 	"os"
+	"reflect"
+	"regexp"
 	"strings"
+
+	"shanhu.io/misc/errcode"
 )
 
 func makeDockerVars(envs []string) map[string]string {
@@ -38,3 +42,100 @@ func makeDockerVars(envs []string) map[string]string {
 
 	return m
 }
+
+// mergeVars merges variables in vars into m. A variable cannot be
+// declared twice.
+func mergeVars(m map[string]string, vars map[string]string) error {
+	for k, v := range vars {
+		if !varNameRegexp.MatchString(k) {
+			return errcode.InvalidArgf("invalid variable name %q", k)
+		}
+		if _, ok := m[k]; ok {
+			return errcode.InvalidArgf("variable %q redeclared", k)
+		}
+		m[k] = v
+	}
+	return nil
+}
+
+var (
+	varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	varRefRegexp  = regexp.MustCompile(`\$?\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+)
+
+// varExpander expands variable references in strings. A reference is
+// ${name}; $${name} is escaped and expanded to a literal ${name}.
+// References to undeclared variables are left untouched, so that shell
+// scripts in rules can still use ${name} for environment variables.
+type varExpander struct {
+	vars map[string]string
+	used map[string]string
+}
+
+func (x *varExpander) expand(s string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	return varRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return strings.TrimPrefix(ref, "$")
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(ref, "${"), "}")
+		v, ok := x.vars[name]
+		if !ok {
+			return ref
+		}
+		x.used[name] = v
+		return v
+	})
+}
+
+func (x *varExpander) expandValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			x.expandValue(v.Elem())
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				x.expandValue(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			x.expandValue(v.Index(i))
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			s := x.expand(iter.Value().String())
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(s).Convert(
+				v.Type().Elem(),
+			))
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(x.expand(v.String()))
+		}
+	}
+}
+
+// expandVars expands the variable references in the string fields of
+// rule r in place, including the strings in slices and the values of
+// maps. It returns the declared variables that are referenced.
+func expandVars(r interface{}, vars map[string]string) map[string]string {
+	x := &varExpander{
+		vars: vars,
+		used: make(map[string]string),
+	}
+	x.expandValue(reflect.ValueOf(r))
+	if len(x.used) == 0 {
+		return nil
+	}
+	return x.used
+}
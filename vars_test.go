@@ -0,0 +1,93 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandVars(t *testing.T) {
+	type inner struct {
+		Path string
+		Tags []string
+	}
+	type rule struct {
+		Name    string
+		Args    []string
+		Envs    map[string]string
+		Counts  map[string]int
+		Inner   inner
+		Ptr     *inner
+		List    []*inner
+		Nil     *inner
+		private string
+	}
+
+	r := &rule{
+		Name:    "${name}",
+		Args:    []string{"-o", "${out}/${name}", "${HOME}"},
+		Envs:    map[string]string{"VERSION": "v${version}"},
+		Counts:  map[string]int{"${name}": 1},
+		Inner:   inner{Path: "${out}", Tags: []string{"${version}"}},
+		Ptr:     &inner{Path: "$${out}"},
+		List:    []*inner{{Path: "${nope}"}, {Tags: []string{"${name}"}}},
+		private: "${name}",
+	}
+	vars := map[string]string{
+		"name":    "app",
+		"out":     "dist",
+		"version": "1.2",
+		"unused":  "x",
+	}
+
+	used := expandVars(r, vars)
+	want := &rule{
+		Name:    "app",
+		Args:    []string{"-o", "dist/app", "${HOME}"},
+		Envs:    map[string]string{"VERSION": "v1.2"},
+		Counts:  map[string]int{"${name}": 1},
+		Inner:   inner{Path: "dist", Tags: []string{"1.2"}},
+		Ptr:     &inner{Path: "${out}"},
+		List:    []*inner{{Path: "${nope}"}, {Tags: []string{"app"}}},
+		private: "${name}",
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+
+	wantUsed := map[string]string{
+		"name":    "app",
+		"out":     "dist",
+		"version": "1.2",
+	}
+	if !reflect.DeepEqual(used, wantUsed) {
+		t.Errorf("got used vars %v, want %v", used, wantUsed)
+	}
+}
+
+func TestExpandVarsUndeclared(t *testing.T) {
+	r := &struct{ Cmd []string }{
+		Cmd: []string{"sh", "-c", "echo ${HOME} $HOME ${}"},
+	}
+	if used := expandVars(r, map[string]string{"x": "y"}); used != nil {
+		t.Errorf("got used vars %v, want none", used)
+	}
+	want := []string{"sh", "-c", "echo ${HOME} $HOME ${}"}
+	if !reflect.DeepEqual(r.Cmd, want) {
+		t.Errorf("got command %q, want %q", r.Cmd, want)
+	}
+}
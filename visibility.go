@@ -0,0 +1,73 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"strings"
+
+	"shanhu.io/misc/errcode"
+)
+
+const (
+	visPublic  = "public"
+	visPrivate = "private"
+)
+
+func checkVisibility(vis []string) error {
+	for _, v := range vis {
+		if v == "" || strings.HasPrefix(v, "/") || strings.Contains(v, ":") {
+			return errcode.InvalidArgf("invalid visibility %q", v)
+		}
+	}
+	return nil
+}
+
+// visibleTo checks if node n is visible to rules in package pkg.
+func visibleTo(n *buildNode, pkg string) bool {
+	if n.typ == nodeSrc || len(n.visibility) == 0 || n.pkg == pkg {
+		return true
+	}
+	for _, v := range n.visibility {
+		switch v {
+		case visPublic:
+			return true
+		case visPrivate:
+			continue
+		}
+		if dir := strings.TrimSuffix(v, "/..."); dir != v {
+			if pkg == dir || strings.HasPrefix(pkg, dir+"/") {
+				return true
+			}
+		} else if pkg == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDepsVisible reports an error for each of the dependencies of
+// rule n that is not visible to n.
+func (l *loader) checkDepsVisible(n *buildNode, deps []*buildNode) {
+	for _, dep := range deps {
+		if dep == nil || visibleTo(dep, n.pkg) {
+			continue
+		}
+		l.errList.Errorf(
+			n.pos, "%q is not visible to %q in package %q",
+			dep.name, n.name, n.pkg,
+		)
+	}
+}
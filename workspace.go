@@ -16,6 +16,10 @@
 package caco3
 
 import (
+	"path"
+	"strings"
+
+	"shanhu.io/misc/errcode"
 	"shanhu.io/misc/jsonx"
 	"shanhu.io/text/lexing"
 )
@@ -24,8 +28,104 @@ import (
 // to build a project.
 type Workspace struct {
 	RepoMap *RepoMap
+
+	// Variables that can be referenced as ${name} in the string fields
+	// of rules in all build files.
+	Vars map[string]string
+
+	DockerRegistry *DockerRegistry
+}
+
+// DockerRegistry specifies how docker image rules are mapped to image
+// repositories. An image rule is named as "prefix/dir/base", where dir is
+// a docker directory and prefix has one or more path segments, and is
+// mapped to "registry/base:tag", where registry is the mapped prefix. With
+// the default settings, "shanhu.io/proj/dockers/base" is mapped to
+// "cr.shanhu.io/proj/base:latest", and "example.com/dockers/base" is
+// mapped to "example.com/base:latest".
+type DockerRegistry struct {
+	// Maps domains or path prefixes of rule names, like "shanhu.io" or
+	// "example.com/proj", to registries, like "cr.shanhu.io". The longest
+	// matching prefix is used, and the rest of the path is kept. Prefixes
+	// that are not mapped are used as is.
+	Registries map[string]string `json:",omitempty"`
+
+	// Names of the docker directories. Default is "dockers" and the names
+	// that end with "-dockers".
+	Dirs []string `json:",omitempty"`
+
+	// Tag of the built and pulled images. Default is "latest".
+	DefaultTag string `json:",omitempty"`
+}
+
+func defaultDockerRegistry() *DockerRegistry {
+	return &DockerRegistry{
+		Registries: map[string]string{"shanhu.io": "cr.shanhu.io"},
+	}
+}
+
+func (r *DockerRegistry) isDockerDir(d string) bool {
+	if len(r.Dirs) == 0 {
+		return d == "dockers" || strings.HasSuffix(d, "-dockers")
+	}
+	for _, dir := range r.Dirs {
+		if d == dir {
+			return true
+		}
+	}
+	return false
 }
 
+func (r *DockerRegistry) registry(prefix string) string {
+	match := ""
+	found := false
+	for k := range r.Registries {
+		if prefix != k && !strings.HasPrefix(prefix, k+"/") {
+			continue
+		}
+		if !found || len(k) > len(match) {
+			match = k
+			found = true
+		}
+	}
+	if !found {
+		return prefix
+	}
+	return path.Join(r.Registries[match], strings.TrimPrefix(prefix, match))
+}
+
+func (r *DockerRegistry) defaultTag() string {
+	if r.DefaultTag == "" {
+		return "latest"
+	}
+	return r.DefaultTag
+}
+
+// repoTag maps the name of a docker image rule to a repo tag. The name
+// has at least three segments: the prefix, the docker directory and the
+// base name.
+func (r *DockerRegistry) repoTag(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 {
+		return "", errcode.InvalidArgf("invalid name %q", name)
+	}
+	n := len(parts)
+	if !r.isDockerDir(parts[n-2]) {
+		return "", errcode.InvalidArgf("not a docker image name: %q", name)
+	}
+	prefix := path.Join(parts[:n-2]...)
+	repo := path.Join(r.registry(prefix), parts[n-1])
+	return repoTag(repo, r.defaultTag()), nil
+}
+
+// Vars is a set of variables. In a workspace file, it sets variables for
+// all build files; in a build file, it sets variables for the rules in the
+// file, overriding the ones in the workspace. Variables are referenced as
+// ${name} in rule string fields and expanded when the build file is
+// loaded. References to undeclared variables are kept as is. Use $${name}
+// for a literal ${name}.
+type Vars map[string]string
+
 // GitRemote defines a set of remote URLs for a given name. It provides a more
 // consistent remote setup for the repositories in the workspace.
 type GitRemote struct {
@@ -45,6 +145,10 @@ func readWorkspace(f string) (*Workspace, []*lexing.Error) {
 		switch t {
 		case "repo_map":
 			return new(RepoMap)
+		case entryVars:
+			return new(Vars)
+		case entryDockerRegistry:
+			return new(DockerRegistry)
 		}
 		return nil
 	}
@@ -54,12 +158,29 @@ func readWorkspace(f string) (*Workspace, []*lexing.Error) {
 	}
 
 	ws := new(Workspace)
+	errList := lexing.NewErrorList()
 	for _, entry := range entries {
 		switch v := entry.V.(type) {
 		case *RepoMap:
 			ws.RepoMap = v
+		case *DockerRegistry:
+			if ws.DockerRegistry != nil {
+				errList.Errorf(entry.Pos, "docker_registry redeclared")
+				continue
+			}
+			ws.DockerRegistry = v
+		case *Vars:
+			if ws.Vars == nil {
+				ws.Vars = make(map[string]string)
+			}
+			if err := mergeVars(ws.Vars, *v); err != nil {
+				errList.Add(&lexing.Error{Pos: entry.Pos, Err: err})
+			}
 		}
 	}
+	if errs := errList.Errs(); errs != nil {
+		return nil, errs
+	}
 	return ws, nil
 }
 
@@ -0,0 +1,107 @@
+// Copyright (C) 2022  Shanhu Tech Inc.
+//
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU Affero General Public License as published by the
+// Free Software Foundation, either version 3 of the License, or (at your
+// option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but WITHOUT
+// ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or
+// FITNESS FOR A PARTICULAR PURPOSE.  See the GNU Affero General Public License
+// for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package caco3
+
+import (
+	"testing"
+
+	"shanhu.io/misc/errcode"
+)
+
+func TestDockerRegistryRepoTag(t *testing.T) {
+	custom := &DockerRegistry{
+		Registries: map[string]string{
+			"example.com":      "registry.example.com",
+			"example.com/team": "team.example.com/images",
+		},
+		Dirs:       []string{"images"},
+		DefaultTag: "dev",
+	}
+
+	for _, test := range []struct {
+		r    *DockerRegistry
+		name string
+		want string // Empty for an invalid name.
+	}{
+		{
+			r:    defaultDockerRegistry(),
+			name: "shanhu.io/proj/dockers/base",
+			want: "cr.shanhu.io/proj/base:latest",
+		},
+		{
+			r:    defaultDockerRegistry(),
+			name: "shanhu.io/proj/web-dockers/nginx",
+			want: "cr.shanhu.io/proj/nginx:latest",
+		},
+		{
+			r:    defaultDockerRegistry(),
+			name: "shanhu.io/dockers/base",
+			want: "cr.shanhu.io/base:latest",
+		},
+		{
+			r:    defaultDockerRegistry(),
+			name: "shanhu.io/a/b/dockers/base",
+			want: "cr.shanhu.io/a/b/base:latest",
+		},
+		{
+			r:    defaultDockerRegistry(),
+			name: "github.com/org/proj/dockers/base",
+			want: "github.com/org/proj/base:latest",
+		},
+		{
+			r:    defaultDockerRegistry(),
+			name: "shanhu.io.evil/dockers/base",
+			want: "shanhu.io.evil/base:latest",
+		},
+		{r: defaultDockerRegistry(), name: "dockers/base"},
+		{r: defaultDockerRegistry(), name: "base"},
+		{r: defaultDockerRegistry(), name: "shanhu.io/proj/images/base"},
+		{
+			r:    custom,
+			name: "example.com/proj/images/app",
+			want: "registry.example.com/proj/app:dev",
+		},
+		{
+			r:    custom,
+			name: "example.com/team/proj/images/app",
+			want: "team.example.com/images/proj/app:dev",
+		},
+		{
+			r:    custom,
+			name: "example.com/team/images/app",
+			want: "team.example.com/images/app:dev",
+		},
+		{r: custom, name: "example.com/proj/dockers/app"},
+	} {
+		got, err := test.r.repoTag(test.name)
+		if test.want == "" {
+			if !errcode.IsInvalidArg(err) {
+				t.Errorf(
+					"repoTag(%q), got %q, %v; want invalid arg",
+					test.name, got, err,
+				)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("repoTag(%q): %s", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("repoTag(%q), got %q, want %q", test.name, got, test.want)
+		}
+	}
+}